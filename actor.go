@@ -0,0 +1,158 @@
+package gosh
+
+import "time"
+
+// RoomActor is a Room whose operations all run one at a time on a goroutine of
+// its own, which callers hand them to and wait on. Expired sessions are removed
+// by the same goroutine between operations, so no other caller or expiry can
+// come between the calls made with one Do. It trades a channel round trip per
+// call for that predictability.
+//
+// The Room keeps its mutex, as the timers it starts for itself, those of
+// SoftDel, Reserve and WithExpiryTombstones, still run on their own goroutines:
+// a soft-deleted session can be purged, a reservation released, or a tombstone
+// forgotten between two calls made with one Do.
+//
+// Expiry callbacks run on the RoomActor's goroutine, unless the Room was
+// created with WithExpiryWorkers, so they must not use the RoomActor, as it
+// would wait on itself.
+type RoomActor struct {
+	room     *Room
+	reaper   *Reaper
+	commands chan func()
+}
+
+// NewRoomActor returns a RoomActor holding an empty Room, created by NewRoom
+// with the lifetime and opts params. The RoomActor removes the Room's expired
+// sessions itself, so a Reaper given by WithSharedReaper isn't used.
+func NewRoomActor(lifetime time.Duration, opts ...Option) *RoomActor {
+	// the Reaper's goroutine isn't started, as the actor takes its kills
+	reaper := &Reaper{
+		kills:  make(chan reap, 0),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithSharedReaper(reaper))
+	actor := &RoomActor{
+		room:     NewRoom(lifetime, opts...),
+		reaper:   reaper,
+		commands: make(chan func(), 0),
+	}
+
+	go actor.run()
+
+	return actor
+}
+
+func (a *RoomActor) run() {
+	defer close(a.reaper.exited)
+
+	for {
+		select {
+		case fn := <-a.commands:
+			fn()
+		case kill := <-a.reaper.kills:
+			err := kill.room.remove(kill.iden, ReasonIdle, kill.watcher)
+			if err != nil {
+				// handle err
+			}
+		case <-a.reaper.done:
+			return
+		}
+	}
+}
+
+// do runs fn on the actor's goroutine and waits for it to return. It returns
+// false without running fn if the RoomActor has been closed.
+func (a *RoomActor) do(fn func()) bool {
+	done := make(chan struct{})
+
+	select {
+	case a.commands <- func() { fn(); close(done) }:
+	case <-a.reaper.done:
+		return false
+	}
+
+	<-done
+	return true
+}
+
+// Add is like Room.Add.
+func (a *RoomActor) Add(iden string) error {
+	var err error
+	if !a.do(func() { err = a.room.Add(iden) }) {
+		return ErrRoomClosed
+	}
+	return err
+}
+
+// AddAuto is like Room.AddAuto.
+func (a *RoomActor) AddAuto() (string, error) {
+	var (
+		iden string
+		err  error
+	)
+	if !a.do(func() { iden, err = a.room.AddAuto() }) {
+		return "", ErrRoomClosed
+	}
+	return iden, err
+}
+
+// Get is like Room.Get.
+func (a *RoomActor) Get(iden, key string) (string, error) {
+	var (
+		value string
+		err   error
+	)
+	if !a.do(func() { value, err = a.room.Get(iden, key) }) {
+		return "", ErrRoomClosed
+	}
+	return value, err
+}
+
+// Set is like Room.Set.
+func (a *RoomActor) Set(iden, key, value string) error {
+	var err error
+	if !a.do(func() { err = a.room.Set(iden, key, value) }) {
+		return ErrRoomClosed
+	}
+	return err
+}
+
+// Del is like Room.Del.
+func (a *RoomActor) Del(iden string) error {
+	var err error
+	if !a.do(func() { err = a.room.Del(iden) }) {
+		return ErrRoomClosed
+	}
+	return err
+}
+
+// Do calls fn with the Room on the RoomActor's goroutine, for operations the
+// RoomActor has no method of its own for, or for several that must happen
+// together. fn must not keep the Room, use the RoomActor, or call methods that
+// wait on the Room, such as GetWait, WaitCreate's channel or CloseContext, as
+// the RoomActor can't remove expired sessions or take other calls until fn
+// returns.
+//
+// Do returns ErrRoomClosed without calling fn if the RoomActor has been closed.
+func (a *RoomActor) Do(fn func(r *Room)) error {
+	if !a.do(func() { fn(a.room) }) {
+		return ErrRoomClosed
+	}
+	return nil
+}
+
+// Close closes the Room, like Room.Close, and then stops the RoomActor's
+// goroutine. Calls made afterwards return ErrRoomClosed, as does Close if the
+// RoomActor was already closed.
+func (a *RoomActor) Close() error {
+	var err error
+	if !a.do(func() { err = a.room.Close() }) {
+		return ErrRoomClosed
+	}
+
+	a.reaper.Close()
+	return err
+}
@@ -0,0 +1,147 @@
+package gosh
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newActor returns a RoomActor that's closed once the test finishes.
+func newActor(t testing.TB, lifetime time.Duration, opts ...Option) *RoomActor {
+	t.Helper()
+
+	a := NewRoomActor(lifetime, opts...)
+	t.Cleanup(func() { a.Close() })
+
+	return a
+}
+
+func TestRoomActor(t *testing.T) {
+	a := newActor(t, time.Minute)
+
+	if err := a.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add("a"); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+	if err := a.Set("a", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Get("a", "k"); v != "v" || err != nil {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	iden, err := a.AddAuto()
+	if err != nil || iden == "" {
+		t.Fatalf("got %q, %v", iden, err)
+	}
+	if err := a.Del("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get("a", "k"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestRoomActorConcurrent(t *testing.T) {
+	a := newActor(t, time.Minute)
+	a.Add("counter")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			iden := strconv.Itoa(i)
+			for j := 0; j < 100; j++ {
+				// a read followed by a write only adds up if nothing else
+				// happens in between
+				a.Do(func(r *Room) {
+					n, _ := r.Get("counter", "n")
+					count, _ := strconv.Atoi(n)
+					r.Set("counter", "n", strconv.Itoa(count+1))
+				})
+
+				a.Add(iden)
+				a.Set(iden, "j", strconv.Itoa(j))
+				if v, err := a.Get(iden, "j"); v != strconv.Itoa(j) || err != nil {
+					t.Errorf("got %q, %v, want %d", v, err, j)
+				}
+				a.Del(iden)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n, _ := a.Get("counter", "n"); n != "800" {
+		t.Fatalf("got %s, want 800", n)
+	}
+	a.Do(func(r *Room) {
+		if keys, _ := r.KeyCount("counter"); keys != 1 || len(r.SessionsByTTL()) != 1 {
+			t.Fatalf("got %v, want only the counter left", r.SessionsByTTL())
+		}
+	})
+}
+
+func TestRoomActorExpiry(t *testing.T) {
+	a := newActor(t, 10*time.Millisecond)
+	removed := make(chan Reason, 1)
+	a.Do(func(r *Room) {
+		r.OnExpire(func(iden string, reason Reason) { removed <- reason })
+	})
+	a.Add("a")
+
+	select {
+	case reason := <-removed:
+		if reason != ReasonIdle {
+			t.Fatalf("got reason %v, want idle", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session didn't expire")
+	}
+	if _, err := a.Get("a", "k"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestRoomActorClose(t *testing.T) {
+	a := NewRoomActor(time.Minute)
+	a.Add("a")
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	for name, err := range map[string]error{
+		"Close": a.Close(),
+		"Add":   a.Add("b"),
+		"Set":   a.Set("a", "k", "v"),
+		"Del":   a.Del("a"),
+		"Get":   func() error { _, err := a.Get("a", "k"); return err }(),
+		"Do":    a.Do(func(*Room) { called = true }),
+	} {
+		if !errors.Is(err, ErrRoomClosed) {
+			t.Errorf("%s: got %v, want ErrRoomClosed", name, err)
+		}
+	}
+	if called {
+		t.Fatal("Do called fn after Close")
+	}
+	waitFor(t, func() bool { return a.room.ActiveWatchers() == 0 })
+}
+
+func BenchmarkGetActor(b *testing.B) {
+	a := newActor(b, time.Minute)
+	a.Add("a")
+	a.Set("a", "k", "v")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			a.Get("a", "k")
+		}
+	})
+}
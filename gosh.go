@@ -3,11 +3,32 @@
 package gosh
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Errors returned by a Room wrap these with details such as the iden and key
+// involved, so they should be matched with errors.Is.
 var (
 	// ErrAlreadyExists is thrown when attempting to create/add a new session
 	// and a session with that identifier already exists in the Room.
@@ -20,182 +41,3930 @@ var (
 	// ErrKeyDoesntExist is thrown when attempting to access a key-value pair
 	// inside of a session, but the key doesn't exist inside that session.
 	ErrKeyDoesntExist = errors.New("that key wasn't found in the session")
+
+	// ErrInvalidLifetime is thrown when attempting to create a Room with a
+	// lifetime that isn't positive.
+	ErrInvalidLifetime = errors.New("session lifetime must be positive")
+
+	// ErrValueTooLarge is thrown when attempting to set a value longer than
+	// the Room's maximum value size.
+	ErrValueTooLarge = errors.New("value exceeds the maximum size")
+
+	// ErrNotABool is thrown when attempting to toggle a value that can't be
+	// parsed as a bool.
+	ErrNotABool = errors.New("that value isn't a bool")
+
+	// ErrNotAnInt is thrown when attempting to increment a value that can't
+	// be parsed as an integer.
+	ErrNotAnInt = errors.New("that value isn't an integer")
+
+	// ErrNotANumber is thrown when attempting to use a value as a number
+	// when it can't be parsed as one.
+	ErrNotANumber = errors.New("that value isn't a number")
+
+	// ErrInvalidBounds is thrown when attempting to increment a value within
+	// bounds whose minimum is greater than their maximum.
+	ErrInvalidBounds = errors.New("min is greater than max")
+
+	// ErrRateLimited is thrown when attempting to create a session faster than
+	// the Room's creation rate limit allows.
+	ErrRateLimited = errors.New("sessions are being created too quickly")
+
+	// ErrFrozen is thrown when attempting to change the Room while it's
+	// frozen.
+	ErrFrozen = errors.New("the room is frozen")
+
+	// ErrInvalidIden can be returned by an iden validator to reject an iden
+	// when attempting to create a session.
+	ErrInvalidIden = errors.New("that iden isn't valid")
+
+	// ErrNotReserved is thrown when attempting to commit a reservation that
+	// was released or has timed out.
+	ErrNotReserved = errors.New("that iden isn't reserved")
+
+	// ErrNotOwned is thrown when attempting to create a session whose iden
+	// belongs to another Room, according to the Room's shard func.
+	ErrNotOwned = errors.New("that iden isn't owned by this room")
+
+	// ErrUnknownKey is thrown when attempting to set a key that isn't in the
+	// Room's strict schema.
+	ErrUnknownKey = errors.New("that key isn't in the schema")
+
+	// ErrVetoed is thrown when attempting to delete a session that the
+	// Room's delete guard wants to keep.
+	ErrVetoed = errors.New("the session's removal was vetoed")
+
+	// ErrRoomClosed is thrown when attempting to use a Room after it has
+	// been closed.
+	ErrRoomClosed = errors.New("the room is closed")
+
+	// ErrKeyExists is thrown when attempting to rename a key inside of a
+	// session to a key that already exists in it.
+	ErrKeyExists = errors.New("that key already exists in the session")
+)
+
+// DefaultReservationTimeout is how long a reservation made by Reserve lasts
+// unless the Room was created with WithReservationTimeout.
+const DefaultReservationTimeout = 30 * time.Second
+
+// stuckKillAfter is how long a kill can wait for the Reaper before StuckKills
+// counts it, unless the Room's stuckAfter is changed by a test.
+const stuckKillAfter = 10 * time.Second
+
+// Reason describes why a session was removed from a Room.
+type Reason int
+
+const (
+	// ReasonIdle means the session expired after its lifetime passed without
+	// any activity.
+	ReasonIdle Reason = iota
+
+	// ReasonManual means the session was removed by a call to Del.
+	ReasonManual
+
+	// ReasonReplaced means the session was removed by a call to ReplaceAll.
+	ReasonReplaced
+
+	// ReasonLimit means the session was removed by a call to
+	// IncrementWithLimit after its counter reached the limit.
+	ReasonLimit
 )
 
+// String returns the name of the reason.
+func (r Reason) String() string {
+	switch r {
+	case ReasonIdle:
+		return "idle"
+	case ReasonManual:
+		return "manual"
+	case ReasonReplaced:
+		return "replaced"
+	case ReasonLimit:
+		return "limit"
+	}
+	return "unknown"
+}
+
 type dispatcher struct {
 	lifetime time.Duration
+	jitter   float64
+	random   *mathrand.Rand
+	warning  time.Duration
+}
+
+func newDispatcher(lifetime time.Duration) *dispatcher {
+	return &dispatcher{
+		lifetime: lifetime,
+		random:   mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// sessionLifetime returns the lifetime of a new session, which is the Room's
+// lifetime randomized by up to the jitter fraction in either direction.
+func (d *dispatcher) sessionLifetime() time.Duration {
+	if d.jitter <= 0 {
+		return d.lifetime
+	}
+
+	return d.lifetime + time.Duration((d.random.Float64()*2-1)*d.jitter*float64(d.lifetime))
+}
+
+// watch calls kill after the left param passes without a ping, and after each
+// ping waits for the session's lifetime again. It stops without calling kill
+// once ping is closed. If the remaining param isn't nil, it's consulted when
+// the timer fires and the watcher keeps waiting for as long as it reports.
+//
+// If the warn param isn't nil, it's called once the session has no more than
+// the dispatcher's warning duration left, at most once per deadline.
+func (d *dispatcher) watch(left, lifetime time.Duration, ping chan struct{}, kill, warn func(), remaining func() time.Duration) {
+	warned := warn == nil
+	for {
+		wait := left
+		if !warned {
+			if left <= d.warning {
+				warn()
+				warned = true
+			} else {
+				wait = left - d.warning
+			}
+		}
+
+		select {
+		case _, ok := <-ping:
+			if !ok {
+				return
+			}
+			left = lifetime
+			warned = warn == nil
+		case <-time.After(wait):
+			if remaining != nil {
+				left = remaining()
+			} else {
+				left -= wait
+			}
+			if left > 0 {
+				// the deadline moved out of the warning period
+				if left > d.warning {
+					warned = warn == nil
+				}
+				continue
+			}
+			kill()
+			return
+		}
+	}
+}
+
+// Reaper removes expired sessions from Rooms. Each Room gets its own Reaper,
+// and so its own goroutine, unless a Reaper is shared between Rooms with
+// WithSharedReaper.
+type Reaper struct {
+	kills  chan reap
+	done   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+}
+
+type reap struct {
+	room    *Room
+	iden    string
+	watcher chan struct{}
+}
+
+// NewReaper returns a Reaper to be shared between Rooms with WithSharedReaper.
+func NewReaper() *Reaper {
+	reaper := &Reaper{
+		kills:  make(chan reap, 0),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	go reaper.killWatch()
+
+	return reaper
 }
 
-func (d *dispatcher) watch(iden string, ping chan struct{}, kill chan string) {
-	left := d.lifetime
+// Close stops the Reaper's goroutine and waits for it to return. A Room closes
+// its own Reaper, but a shared one must be closed by whoever created it once
+// every Room using it has been closed, as their sessions would never expire
+// otherwise. Calling Close more than once does nothing.
+func (r *Reaper) Close() {
+	r.stop()
+	<-r.exited
+}
+
+// stop makes the Reaper's goroutine return without waiting for it.
+func (r *Reaper) stop() {
+	r.once.Do(func() { close(r.done) })
+}
+
+func (r *Reaper) killWatch() {
+	defer close(r.exited)
 
 	for {
 		select {
-		case <-ping:
-			left = d.lifetime
-		case <-time.After(left):
-			kill <- iden
+		case kill := <-r.kills:
+			err := kill.room.remove(kill.iden, ReasonIdle, kill.watcher)
+			if err != nil {
+				// handle err
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// limiter is a token bucket holding up to n tokens, refilled at n per period.
+type limiter struct {
+	n      float64
+	per    time.Duration
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(n int, per time.Duration) *limiter {
+	return &limiter{
+		n:      float64(n),
+		per:    per,
+		tokens: float64(n),
+		last:   time.Now(),
+	}
+}
+
+// take removes a token from the bucket, returning false if it's empty.
+func (l *limiter) take() bool {
+	now := time.Now()
+
+	l.tokens += float64(now.Sub(l.last)) / float64(l.per) * l.n
+	if l.tokens > l.n {
+		l.tokens = l.n
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	return true
+}
+
+// softDeleted is a session removed by SoftDel that can still be restored.
+type softDeleted struct {
+	values map[string]string
+	hook   func()
+	aead   cipher.AEAD
+	timer  *time.Timer
+}
+
+// expiryPool calls expiry callbacks from a fixed number of goroutines, so that
+// slow callbacks never hold up the Reaper. Callbacks are queued without limit
+// until a goroutine is free to call them.
+type expiryPool struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending []func()
+	stopped bool
+	workers int
+}
+
+func newExpiryPool(n int) *expiryPool {
+	p := &expiryPool{workers: n}
+	p.cond = sync.NewCond(&p.mutex)
+
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// add queues the callback to be called. It never blocks on the workers. Once
+// the pool is stopped its workers may have returned, so the callback is called
+// before add returns instead.
+func (p *expiryPool) add(fn func()) {
+	p.mutex.Lock()
+	if p.stopped {
+		p.mutex.Unlock()
+		fn()
+		return
+	}
+	p.pending = append(p.pending, fn)
+	p.mutex.Unlock()
+
+	p.cond.Signal()
+}
+
+// stop makes the workers return once every queued callback has been called.
+func (p *expiryPool) stop() {
+	p.mutex.Lock()
+	p.stopped = true
+	p.mutex.Unlock()
+
+	p.cond.Broadcast()
+}
+
+func (p *expiryPool) work() {
+	for {
+		p.mutex.Lock()
+		for len(p.pending) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if len(p.pending) == 0 {
+			p.mutex.Unlock()
 			return
 		}
+		fn := p.pending[0]
+		p.pending = p.pending[1:]
+		p.mutex.Unlock()
+
+		fn()
+	}
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Iden   string    `json:"iden"`
+	Key    string    `json:"key,omitempty"`
+	Value  *string   `json:"value,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// auditLog writes audit entries to a writer from its own goroutine, so that
+// slow writes never hold up the Room. Entries are queued without limit until
+// they're written.
+type auditLog struct {
+	w       io.Writer
+	mutex   sync.Mutex
+	pending []auditEntry
+	notify  chan struct{}
+	err     error
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{
+		w:      w,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// add queues the entry to be written. It never blocks on the writer.
+func (a *auditLog) add(entry auditEntry) {
+	a.mutex.Lock()
+	a.pending = append(a.pending, entry)
+	a.mutex.Unlock()
+
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (a *auditLog) run() {
+	encoder := json.NewEncoder(a.w)
+
+	for range a.notify {
+		a.mutex.Lock()
+		pending := a.pending
+		a.pending = nil
+		a.mutex.Unlock()
+
+		for _, entry := range pending {
+			if err := encoder.Encode(entry); err != nil {
+				a.fail(err)
+			}
+		}
+	}
+}
+
+// fail keeps the err param, unless an earlier error was already kept.
+func (a *auditLog) fail(err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.err == nil {
+		a.err = err
 	}
 }
 
+// Change is a change made to a key inside of a session, as recorded when the
+// Room is created with WithKeyHistory.
+type Change struct {
+	// Key is the key that was changed.
+	Key string
+
+	// Old is the value before the change, or empty if the key didn't exist.
+	Old string
+
+	// New is the value after the change, or empty if the key was deleted.
+	New string
+
+	// Time is when the change was made.
+	Time time.Time
+}
+
+// SessionInfo describes a session without its key-value pairs.
+type SessionInfo struct {
+	// Iden identifies the session.
+	Iden string
+
+	// TTL is how long the session has left to live without activity.
+	TTL time.Duration
+
+	// CreatedAt is when the session was created.
+	CreatedAt time.Time
+
+	// LastAccess is when the session's timer was last reset by activity, or
+	// when it was created if there hasn't been any.
+	LastAccess time.Time
+}
+
 // Room holds multiple sessions.
 type Room struct {
-	mutex sync.Mutex
+	mutex      sync.Mutex
+	settled    *sync.Cond
+	active     atomic.Int64
+	stuckKills atomic.Int64
+	watching   sync.WaitGroup
+
+	sessions    map[string]map[string]string
+	watchers    map[string]chan struct{}
+	deadlines   map[string]time.Time
+	lifetimes   map[string]time.Duration
+	dispatcher  *dispatcher
+	reaper      *Reaper
+	onExpire    []*func(string, Reason)
+	hooks       map[string]func()
+	tags        map[string]map[string]struct{}
+	created     map[string]chan struct{}
+	creators    map[string]int
+	changes     map[string]chan struct{}
+	removals    chan struct{}
+	stores      chan struct{}
+	keyWaiters  map[[2]string]int
+	valWaiters  map[[2]string]int
+	streams     map[*auditLog]struct{}
+	groups      map[string]map[string]struct{}
+	groupOf     map[string]string
+	compressed  map[string]map[string]struct{}
+	softDeleted map[string]*softDeleted
+	history     map[string][]Change
+	migrated    map[string]struct{}
+	reserved    map[string]*time.Timer
+	ciphers     map[string]cipher.AEAD
+	modified    map[string]map[string]time.Time
+	stacks      map[string]string
+	createdAt   map[string]time.Time
+	accessed    map[string]time.Time
+	expired     map[string]time.Time
+	version     uint64
+	versions    map[string]uint64
+	removed     map[string]uint64
+	checkpoints bool
 
-	sessions   map[string]map[string]string
-	watchers   map[string]chan struct{}
-	dispatcher *dispatcher
-	killer     chan string
+	maxValueBytes int
+	loader        Loader
+	idenSource    func() string
+	coalesce      bool
+	createLimit   *limiter
+	frozen        bool
+	idenValidator func(string) error
+	compressAbove int
+	audit         *auditLog
+	auditValues   bool
+	historySize   int
+	migrator      Migrator
+	reserveFor    time.Duration
+	onWarning     func(string)
+	expiryPool    *expiryPool
+	tombstone     *string
+	traceCreation bool
+	shardFunc     func(string) bool
+	minReset      time.Duration
+	factory       Factory
+	policy        ExpiryPolicy
+	schema        map[string]struct{}
+	strictSchema  bool
+	onUnknownKey  func(string, string)
+	tombstoneTTL  time.Duration
+	deleteGuard   func(string, Reason) bool
+	ownsReaper    bool
+	granularity   time.Duration
+	stuckAfter    time.Duration
+	closed        bool
+	expiring      int
 }
 
 // NewRoom returns an empty Room. The lifetime param specifies how long each
 // session inside the Room will live without activity. After the lifetime has
 // expired, the session is automatically deleted from the Room.
-func NewRoom(lifetime time.Duration) *Room {
+//
+// The opts params are applied to the Room before it's returned.
+func NewRoom(lifetime time.Duration, opts ...Option) *Room {
 	room := &Room{
-		sessions:   make(map[string]map[string]string, 0),
-		watchers:   make(map[string]chan struct{}),
-		dispatcher: &dispatcher{lifetime},
-		killer:     make(chan string, 0),
+		sessions:    make(map[string]map[string]string, 0),
+		watchers:    make(map[string]chan struct{}),
+		deadlines:   make(map[string]time.Time),
+		lifetimes:   make(map[string]time.Duration),
+		dispatcher:  newDispatcher(lifetime),
+		hooks:       make(map[string]func()),
+		tags:        make(map[string]map[string]struct{}),
+		created:     make(map[string]chan struct{}),
+		creators:    make(map[string]int),
+		changes:     make(map[string]chan struct{}),
+		groups:      make(map[string]map[string]struct{}),
+		groupOf:     make(map[string]string),
+		compressed:  make(map[string]map[string]struct{}),
+		softDeleted: make(map[string]*softDeleted),
+		history:     make(map[string][]Change),
+		migrated:    make(map[string]struct{}),
+		reserved:    make(map[string]*time.Timer),
+		ciphers:     make(map[string]cipher.AEAD),
+		modified:    make(map[string]map[string]time.Time),
+		stacks:      make(map[string]string),
+		createdAt:   make(map[string]time.Time),
+		accessed:    make(map[string]time.Time),
+		expired:     make(map[string]time.Time),
+		keyWaiters:  make(map[[2]string]int),
+		valWaiters:  make(map[[2]string]int),
+		streams:     make(map[*auditLog]struct{}),
+		versions:    make(map[string]uint64),
+		removed:     make(map[string]uint64),
+		idenSource:  randomIden,
+		reserveFor:  DefaultReservationTimeout,
+		stuckAfter:  stuckKillAfter,
+	}
+
+	room.settled = sync.NewCond(&room.mutex)
+
+	for _, opt := range opts {
+		opt(room)
 	}
 
-	go room.killWatch()
+	if room.reaper == nil {
+		room.reaper = NewReaper()
+		room.ownsReaper = true
+	}
+	if room.audit != nil {
+		go room.audit.run()
+	}
 
 	return room
 }
 
-func (r *Room) killWatch() {
-	for {
-		select {
-		case iden := <-r.killer:
-			err := r.Del(iden)
-			if err != nil {
-				// handle err
-			}
-		}
+// NewRoomChecked is like NewRoom, but returns an error if the lifetime param
+// isn't positive. NewRoom accepts any lifetime, so a zero or negative lifetime
+// makes every session expire almost immediately.
+func NewRoomChecked(lifetime time.Duration, opts ...Option) (*Room, error) {
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLifetime, lifetime)
 	}
+
+	return NewRoom(lifetime, opts...), nil
 }
 
-func (r *Room) accessCheck(iden, key string) error {
+func (r *Room) accessCheck(iden string) error {
+	if r.closed {
+		return sessionError(ErrRoomClosed, iden)
+	}
 	if _, ok := r.sessions[iden]; !ok {
-		return ErrDoesntExist
+		return sessionError(ErrDoesntExist, iden)
 	}
 	if _, ok := r.watchers[iden]; !ok {
-		return ErrDoesntExist
+		return sessionError(ErrDoesntExist, iden)
 	}
-	if key != "" {
-		if _, ok := r.sessions[iden][key]; !ok {
-			return ErrKeyDoesntExist
-		}
+	return nil
+}
+
+// keyCheck is like accessCheck, but also checks that the key exists inside of
+// the session. Any string is a valid key, including the empty string.
+func (r *Room) keyCheck(iden, key string) error {
+	if err := r.accessCheck(iden); err != nil {
+		return err
+	}
+	if _, ok := r.sessions[iden][key]; !ok {
+		return keyError(ErrKeyDoesntExist, iden, key)
+	}
+	return nil
+}
+
+// writeCheck is like accessCheck, but also fails if the Room is frozen.
+func (r *Room) writeCheck(iden string) error {
+	if r.frozen {
+		return sessionError(ErrFrozen, iden)
+	}
+	return r.accessCheck(iden)
+}
+
+func (r *Room) sizeCheck(value string) error {
+	if r.maxValueBytes > 0 && len(value) > r.maxValueBytes {
+		return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, len(value))
+	}
+	return nil
+}
+
+// schemaCheck returns an error if the key isn't in the Room's schema and the
+// schema is strict. If it isn't strict, the unknown key hook is called instead.
+func (r *Room) schemaCheck(iden, key string) error {
+	if r.schema == nil {
+		return nil
+	}
+	if _, ok := r.schema[key]; ok {
+		return nil
+	}
+	if r.strictSchema {
+		return keyError(ErrUnknownKey, iden, key)
+	}
+	if r.onUnknownKey != nil {
+		r.onUnknownKey(iden, key)
 	}
 	return nil
 }
 
-// Add creates a new session identified by the iden param.
+// Add creates a new session identified by the iden param. If the Room was
+// created with WithFactory, the session holds the values the factory returns.
 //
-// Add returns an error if a session with that iden already exists.
+// Add returns an error if a session with that iden already exists, the Room's
+// creation rate limit has been reached, or the factory fails.
 func (r *Room) Add(iden string) error {
+	return r.addSeeded(iden, true)
+}
+
+// AddPriority is like Add, but isn't subject to the Room's creation rate limit,
+// so that critical internal sessions can be created however busy the Room is.
+// If the Room was created with WithFactory, the session still holds the values
+// the factory returns.
+//
+// AddPriority returns an error if a session with that iden already exists, the
+// factory fails, or the Room won't accept it for other reasons, such as being
+// frozen.
+func (r *Room) AddPriority(iden string) error {
+	return r.addSeeded(iden, false)
+}
+
+// AddMany creates a new session for each of the idens params while locking the
+// Room only once. It returns the error for each iden that couldn't be added,
+// so the map is empty if every session was created.
+func (r *Room) AddMany(idens []string) map[string]error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if _, ok := r.sessions[iden]; ok {
-		return ErrAlreadyExists
+	errs := make(map[string]error)
+
+	for _, iden := range idens {
+		if err := r.add(iden); err != nil {
+			errs[iden] = err
+		}
 	}
-	if _, ok := r.watchers[iden]; ok {
-		return ErrAlreadyExists
+
+	return errs
+}
+
+// AddEncrypted is like Add, but the session's values are kept encrypted in
+// memory with AES-GCM using the key param, which must be 16, 24 or 32 bytes
+// long. Encryption is invisible to callers: every method of the Room,
+// including ExportCSV and WriteTo, works with the decrypted values. Sessions
+// read back by ReadFrom aren't encrypted.
+//
+// AddEncrypted returns an error if the key isn't valid or the session couldn't
+// be created.
+func (r *Room) AddEncrypted(iden string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
 	}
 
-	r.sessions[iden] = make(map[string]string, 0)
-	r.watchers[iden] = make(chan struct{}, 0)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	go r.dispatcher.watch(iden, r.watchers[iden], r.killer)
+	if err := r.add(iden); err != nil {
+		return err
+	}
+	r.ciphers[iden] = aead
 
 	return nil
 }
 
-// Get is for getting session values. The session is identified by the iden
-// parameter. The key parameter is used to find the key-value pair, with the
-// value being returned (if found).
+// AddOnce is like Add, but reports whether this call created the session
+// instead of returning ErrAlreadyExists. When many goroutines race to add the
+// same session, exactly one of them gets true.
 //
-// Get returns an error if the session doesn't exist or a value doesn't exist
-// for the specified key.
-func (r *Room) Get(iden, key string) (string, error) {
+// AddOnce returns an error if the session couldn't be created for any other
+// reason.
+func (r *Room) AddOnce(iden string) (bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if err := r.accessCheck(iden, key); err != nil {
-		return "", err
+	if err := r.add(iden); err != nil {
+		if errors.Is(err, ErrAlreadyExists) {
+			return false, nil
+		}
+		return false, err
 	}
 
-	r.watchers[iden] <- struct{}{}
-
-	return r.sessions[iden][key], nil
+	return true, nil
 }
 
-// GetBatch is for getting multiple session values. The session is identified
-// by the iden parameter. The key parameters are used to find their key-value
-// pairs, with the values being returned in a string slice.
+// Reserve reserves the iden param for a session that's about to be created, so
+// adding a session with that iden returns ErrAlreadyExists in the meantime.
+// The session is created by calling commit, while release gives up the
+// reservation. Reservations that are neither committed nor released are
+// released automatically after the Room's reservation timeout.
 //
-// GetBatch returns an error if the session doesn't exist or one of the values
-// don't exist for the specified key.
-func (r *Room) GetBatch(iden string, keys ...string) ([]string, error) {
+// Reserve returns an error if the session couldn't be created. commit returns
+// ErrNotReserved if the reservation was already released, or any error from
+// creating the session.
+func (r *Room) Reserve(iden string) (func() error, func(), error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if err := r.accessCheck(iden, ""); err != nil {
-		return nil, err
+	if err := r.createCheck(iden); err != nil {
+		return nil, nil, err
 	}
 
-	r.watchers[iden] <- struct{}{}
+	var timer *time.Timer
+	release := func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
 
-	var (
-		values = make([]string, len(keys), len(keys))
-		ok     bool
-	)
+		if r.reserved[iden] == timer {
+			timer.Stop()
+			delete(r.reserved, iden)
+		}
+	}
+	commit := func() error {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
 
-	for i, k := range keys {
-		if _, ok = r.sessions[iden][k]; !ok {
-			return nil, ErrKeyDoesntExist
+		if r.closed {
+			return sessionError(ErrRoomClosed, iden)
 		}
-		values[i] = r.sessions[iden][k]
+		if r.reserved[iden] != timer {
+			return sessionError(ErrNotReserved, iden)
+		}
+		timer.Stop()
+		delete(r.reserved, iden)
+
+		return r.add(iden)
 	}
 
-	return values, nil
+	timer = time.AfterFunc(r.reserveFor, release)
+	r.reserved[iden] = timer
+
+	return commit, release, nil
 }
 
-// Set is for setting session key-value pairs. The session is identified by the
-// iden parameter. The key-value pair is specified by the key and value
-// parameters.
+// AddWith creates a new session identified by the iden param, holding copies of
+// the values param's key-value pairs. The session never exists without them.
 //
-// Set returns an error if the session doesn't exist.
-func (r *Room) Set(iden, key, value string) error {
+// AddWith returns an error if the session couldn't be created or one of the
+// values is larger than the Room allows.
+func (r *Room) AddWith(iden string, values map[string]string) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if err := r.accessCheck(iden, ""); err != nil {
+	for k, v := range values {
+		if err := r.sizeCheck(v); err != nil {
+			return err
+		}
+		if err := r.schemaCheck(iden, k); err != nil {
+			return err
+		}
+	}
+	if err := r.add(iden); err != nil {
 		return err
 	}
 
-	r.watchers[iden] <- struct{}{}
-	r.sessions[iden][key] = value
+	for k, v := range values {
+		r.store(iden, k, v)
+	}
 
 	return nil
 }
 
-// Del deletes the session specified by the iden parameter. It returns an error
-// if the session doesn't exist.
-func (r *Room) Del(iden string) error {
+// GetOrCreate returns a copy of the session identified by the iden param,
+// creating an empty session first if it doesn't exist. The bool is true if the
+// session was created.
+//
+// GetOrCreate returns an error if the session had to be created and couldn't
+// be.
+func (r *Room) GetOrCreate(iden string) (map[string]string, bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if err := r.accessCheck(iden, ""); err != nil {
-		return err
+	r.migrate(iden)
+	if err := r.accessCheck(iden); err != nil {
+		if err := r.add(iden); err != nil {
+			return nil, false, err
+		}
+		return make(map[string]string), true, nil
 	}
 
-	delete(r.sessions, iden)
-	delete(r.watchers, iden)
+	r.touch(iden)
 
-	return nil
+	return r.values(iden), false, nil
+}
+
+// AddAuto creates a new session with a generated iden and returns the iden. By
+// default idens are 32 hex characters read from crypto/rand; WithIdenSource
+// replaces the generator. Like Add, it seeds the session with the Room's
+// factory, if any.
+//
+// AddAuto returns an error if a session with the generated iden already
+// exists, or the session couldn't be created for the same reasons as Add.
+func (r *Room) AddAuto() (string, error) {
+	r.mutex.Lock()
+	iden := r.idenSource()
+	r.mutex.Unlock()
+
+	if err := r.addSeeded(iden, true); err != nil {
+		return "", err
+	}
+
+	return iden, nil
+}
+
+// watch starts a new watcher for the session, which kills it after the left
+// param passes without activity. The caller must hold the lock.
+func (r *Room) watch(iden string, left time.Duration) {
+	if watcher, ok := r.watchers[iden]; ok {
+		close(watcher)
+	}
+
+	watcher := make(chan struct{}, 1)
+	r.watchers[iden] = watcher
+	r.deadlines[iden] = r.deadline(iden, left)
+	if r.policy != nil {
+		left = time.Until(r.deadlines[iden])
+	}
+
+	var remaining func() time.Duration
+	if r.coalesce || r.policy != nil {
+		remaining = func() time.Duration { return r.remaining(iden) }
+	}
+
+	stuckAfter := r.stuckAfter
+	kill := func() {
+		stuck := time.AfterFunc(stuckAfter, func() { r.stuckKills.Add(1) })
+		select {
+		case r.reaper.kills <- reap{room: r, iden: iden, watcher: watcher}:
+		case <-r.reaper.done:
+			// the Room was closed and its Reaper stopped
+		}
+		if !stuck.Stop() {
+			r.stuckKills.Add(-1)
+		}
+	}
+
+	var warn func()
+	if r.onWarning != nil {
+		warn = func() { r.warn(iden, watcher) }
+	}
+
+	lifetime := r.lifetimes[iden]
+
+	r.active.Add(1)
+	r.watching.Add(1)
+	go func() {
+		defer r.watching.Done()
+		defer r.active.Add(-1)
+		r.dispatcher.watch(left, lifetime, watcher, kill, warn, remaining)
+	}()
+}
+
+// warn calls the Room's expiry warning callback for the session, unless the
+// watcher has been replaced or expiry is paused because the Room is frozen.
+func (r *Room) warn(iden string, watcher chan struct{}) {
+	r.mutex.Lock()
+	skip := r.frozen || r.watchers[iden] != watcher
+	r.mutex.Unlock()
+
+	if !skip {
+		r.onWarning(iden)
+	}
+}
+
+// WaitCreate returns a channel that's closed once a session identified by the
+// iden param is added to the Room. If the session already exists, the channel
+// is already closed. The channel is also closed when the Room is closed, so
+// that waiters aren't left waiting forever.
+//
+// Waiters never block the Room, so the channel doesn't have to be received
+// from. All waiters for the same iden share one channel, which is held by the
+// Room until the session is added, or until every waiter has given up by
+// calling the cancel func returned along with it. Waiters for idens that may
+// never be added should call cancel once they stop waiting, so the Room
+// doesn't hold on to their channel.
+func (r *Room) WaitCreate(iden string) (<-chan struct{}, func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.sessions[iden]; ok || r.closed {
+		created := make(chan struct{})
+		close(created)
+		return created, func() {}
+	}
+
+	created, ok := r.created[iden]
+	if !ok {
+		created = make(chan struct{})
+		r.created[iden] = created
+	}
+	r.creators[iden]++
+
+	cancelled := false
+	cancel := func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		// the channel is gone if the session was added or the Room closed
+		if cancelled || r.created[iden] != created {
+			return
+		}
+		cancelled = true
+
+		r.creators[iden]--
+		if r.creators[iden] == 0 {
+			delete(r.created, iden)
+			delete(r.creators, iden)
+		}
+	}
+
+	return created, cancel
+}
+
+// addSeeded creates the session holding the values returned by the Room's
+// factory, if any. The factory is called without the lock, after checking that
+// the session could be created, so it isn't called in vain. The Room's creation
+// rate limit only applies if the limited param is true.
+func (r *Room) addSeeded(iden string, limited bool) error {
+	var values map[string]string
+
+	if r.factory != nil {
+		r.mutex.Lock()
+		err := r.createCheck(iden)
+		r.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if values, err = r.factory(iden); err != nil {
+			return sessionError(err, iden)
+		}
+		for _, v := range values {
+			if err := r.sizeCheck(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	add := r.add
+	if !limited {
+		add = r.addUnlimited
+	}
+
+	// the session may have been created while the factory ran
+	if err := add(iden); err != nil {
+		return err
+	}
+	for k, v := range values {
+		r.store(iden, k, v)
+	}
+
+	return nil
+}
+
+// add creates the session and starts its watcher. The caller must hold the
+// lock.
+func (r *Room) add(iden string) error {
+	if err := r.createCheck(iden); err != nil {
+		return err
+	}
+	if r.createLimit != nil && !r.createLimit.take() {
+		return sessionError(ErrRateLimited, iden)
+	}
+
+	r.create(iden)
+	r.watch(iden, r.lifetimes[iden])
+
+	return nil
+}
+
+// addUnlimited is like add, but isn't subject to the Room's creation rate
+// limit. The caller must hold the lock.
+func (r *Room) addUnlimited(iden string) error {
+	if err := r.createCheck(iden); err != nil {
+		return err
+	}
+
+	r.create(iden)
+	r.watch(iden, r.lifetimes[iden])
+
+	return nil
+}
+
+// OwnsIden returns whether the Room accepts sessions identified by the iden
+// param, according to the shard func it was created with. A Room created
+// without WithShardFunc owns every iden.
+func (r *Room) OwnsIden(iden string) bool {
+	return r.shardFunc == nil || r.shardFunc(iden)
+}
+
+func (r *Room) createCheck(iden string) error {
+	if r.closed {
+		return sessionError(ErrRoomClosed, iden)
+	}
+	if r.frozen {
+		return sessionError(ErrFrozen, iden)
+	}
+	if _, ok := r.sessions[iden]; ok {
+		return sessionError(ErrAlreadyExists, iden)
+	}
+	if _, ok := r.watchers[iden]; ok {
+		return sessionError(ErrAlreadyExists, iden)
+	}
+	return r.idenCheck(iden)
+}
+
+// idenCheck returns an error if the Room won't accept a session identified by
+// the iden, whether or not such a session exists already.
+func (r *Room) idenCheck(iden string) error {
+	if _, ok := r.reserved[iden]; ok {
+		return sessionError(ErrAlreadyExists, iden)
+	}
+	if !r.OwnsIden(iden) {
+		return sessionError(ErrNotOwned, iden)
+	}
+	if r.idenValidator != nil {
+		if err := r.idenValidator(iden); err != nil {
+			return sessionError(err, iden)
+		}
+	}
+	return nil
+}
+
+// sessionError adds the iden to err. The result still matches err with
+// errors.Is.
+func sessionError(err error, iden string) error {
+	return fmt.Errorf("%w: iden %q", err, iden)
+}
+
+// keyError adds the iden and key to err. The result still matches err with
+// errors.Is.
+func keyError(err error, iden, key string) error {
+	return fmt.Errorf("%w: iden %q, key %q", err, iden, key)
+}
+
+// create makes an empty session, without starting its watcher. The caller must
+// hold the lock, and must start the watcher.
+func (r *Room) create(iden string) {
+	r.sessions[iden] = make(map[string]string, 0)
+	r.lifetimes[iden] = r.dispatcher.sessionLifetime()
+	r.createdAt[iden] = time.Now()
+	r.accessed[iden] = r.createdAt[iden]
+	r.bump(iden)
+	delete(r.removed, iden)
+	delete(r.expired, iden)
+	if r.traceCreation {
+		r.stacks[iden] = string(debug.Stack())
+	}
+	r.record(auditEntry{Op: "add", Iden: iden})
+
+	if created, ok := r.created[iden]; ok {
+		close(created)
+		delete(r.created, iden)
+		delete(r.creators, iden)
+	}
+}
+
+func randomIden() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Get is for getting session values. The session is identified by the iden
+// parameter. The key parameter is used to find the key-value pair, with the
+// value being returned (if found).
+//
+// Get returns an error if the session doesn't exist or a value doesn't exist
+// for the specified key.
+//
+// If the Room has a loader and the session exists but the key doesn't, the
+// loader is called to fetch the value, which is then stored in the session.
+func (r *Room) Get(iden, key string) (string, error) {
+	r.mutex.Lock()
+
+	r.migrate(iden)
+	if err := r.keyCheck(iden, key); !errors.Is(err, ErrKeyDoesntExist) || r.loader == nil {
+		defer r.mutex.Unlock()
+
+		if err != nil {
+			return "", err
+		}
+
+		r.touch(iden)
+		value, _ := r.value(iden, key)
+
+		return value, nil
+	}
+
+	loader := r.loader
+	r.touch(iden)
+	r.mutex.Unlock()
+
+	return r.load(loader, iden, key)
+}
+
+// load calls the loader for a missing key and stores the value it finds. The
+// loader is called without the lock held.
+func (r *Room) load(loader Loader, iden, key string) (string, error) {
+	value, found, err := loader(iden, key)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", keyError(ErrKeyDoesntExist, iden, key)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return "", err
+	}
+
+	// the key may have been set while the loader was running
+	if stored, ok := r.value(iden, key); ok {
+		return stored, nil
+	}
+	if r.frozen {
+		return value, nil
+	}
+	r.store(iden, key, value)
+	r.changed(iden)
+
+	return value, nil
+}
+
+// TryGet is like Get, but never waits for the lock. It returns false if the
+// Room is locked by another operation, or if the session or key doesn't exist.
+// The loader isn't called.
+func (r *Room) TryGet(iden, key string) (string, bool) {
+	if !r.mutex.TryLock() {
+		return "", false
+	}
+	defer r.mutex.Unlock()
+
+	r.migrate(iden)
+	if err := r.keyCheck(iden, key); err != nil {
+		return "", false
+	}
+
+	r.touch(iden)
+
+	return r.value(iden, key)
+}
+
+// GetFull is like Get, but reports whether the session and the key exist
+// instead of returning ErrDoesntExist or ErrKeyDoesntExist. The session's timer
+// is reset if it exists. The error is reserved for other failures, such as the
+// Room being closed.
+func (r *Room) GetFull(iden, key string) (string, bool, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.migrate(iden)
+	if err := r.accessCheck(iden); err != nil {
+		if errors.Is(err, ErrRoomClosed) {
+			return "", false, false, err
+		}
+		return "", false, false, nil
+	}
+
+	r.touch(iden)
+	value, ok := r.value(iden, key)
+
+	return value, true, ok, nil
+}
+
+// GetWait is like Get, but if the session exists and the key doesn't, it waits
+// for the key to be set.
+//
+// GetWait returns an error if the session doesn't exist or is removed while
+// waiting, or if ctx is done before the key is set.
+func (r *Room) GetWait(ctx context.Context, iden, key string) (string, error) {
+	target := [2]string{iden, key}
+	waiting := false
+
+	for {
+		r.mutex.Lock()
+		if waiting {
+			r.wait(r.keyWaiters, target, -1)
+			waiting = false
+		}
+
+		r.migrate(iden)
+		err := r.keyCheck(iden, key)
+		if err == nil {
+			r.touch(iden)
+			value, _ := r.value(iden, key)
+			r.mutex.Unlock()
+			return value, nil
+		}
+		if !errors.Is(err, ErrKeyDoesntExist) {
+			r.mutex.Unlock()
+			return "", err
+		}
+
+		changes := r.nextChange(iden)
+		r.wait(r.keyWaiters, target, 1)
+		waiting = true
+		r.mutex.Unlock()
+
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			r.mutex.Lock()
+			r.wait(r.keyWaiters, target, -1)
+			r.mutex.Unlock()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// WaitForValue waits until a session holds the value param under the key
+// param and returns its iden. If several sessions already do, any one of them
+// is returned. The Room is only checked again when a value is stored, but each
+// check looks through every session, so it's best kept to Rooms of modest size
+// or that are written to rarely. No session is touched.
+//
+// WaitForValue returns an error if ctx is done first.
+func (r *Room) WaitForValue(ctx context.Context, key, value string) (string, error) {
+	target := [2]string{key, value}
+	waiting := false
+
+	for {
+		r.mutex.Lock()
+		if waiting {
+			r.wait(r.valWaiters, target, -1)
+			waiting = false
+		}
+
+		if r.closed {
+			r.mutex.Unlock()
+			return "", ErrRoomClosed
+		}
+
+		for iden := range r.sessions {
+			if v, ok := r.value(iden, key); ok && v == value {
+				r.mutex.Unlock()
+				return iden, nil
+			}
+		}
+
+		if r.stores == nil {
+			r.stores = make(chan struct{})
+		}
+		stores := r.stores
+		r.wait(r.valWaiters, target, 1)
+		waiting = true
+		r.mutex.Unlock()
+
+		select {
+		case <-stores:
+		case <-ctx.Done():
+			r.mutex.Lock()
+			r.wait(r.valWaiters, target, -1)
+			r.mutex.Unlock()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// GetBatch is for getting multiple session values. The session is identified
+// by the iden parameter. The key parameters are used to find their key-value
+// pairs, with the values being returned in a string slice.
+//
+// GetBatch returns an error if the session doesn't exist or one of the values
+// don't exist for the specified key.
+func (r *Room) GetBatch(iden string, keys ...string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.migrate(iden)
+	if err := r.accessCheck(iden); err != nil {
+		return nil, err
+	}
+
+	r.touch(iden)
+
+	var (
+		values = make([]string, len(keys), len(keys))
+		ok     bool
+	)
+
+	for i, k := range keys {
+		if values[i], ok = r.value(iden, k); !ok {
+			return nil, keyError(ErrKeyDoesntExist, iden, k)
+		}
+	}
+
+	return values, nil
+}
+
+// GetAllMulti returns copies of the sessions identified by the idens params,
+// mapped by their idens, while locking the Room only once. The sessions are
+// touched.
+//
+// GetAllMulti returns an error if any of the sessions doesn't exist, in which
+// case none of them are touched.
+func (r *Room) GetAllMulti(idens ...string) (map[string]map[string]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, iden := range idens {
+		r.migrate(iden)
+		if err := r.accessCheck(iden); err != nil {
+			return nil, err
+		}
+	}
+
+	sessions := make(map[string]map[string]string, len(idens))
+	for _, iden := range idens {
+		r.touch(iden)
+		sessions[iden] = r.values(iden)
+	}
+
+	return sessions, nil
+}
+
+// GetBytes is like Get, but returns the value as a byte slice. Values are
+// stored as strings, which can hold any bytes, so GetBytes can read values
+// stored by Set and Get can read values stored by SetBytes. The returned slice
+// is a copy, so it's safe to modify.
+func (r *Room) GetBytes(iden, key string) ([]byte, error) {
+	value, err := r.Get(iden, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(value), nil
+}
+
+// Set is for setting session key-value pairs. The session is identified by the
+// iden parameter. The key-value pair is specified by the key and value
+// parameters.
+//
+// If the Room was created with WithTombstone, setting the tombstone value
+// deletes the key instead of storing it.
+//
+// Set returns an error if the session doesn't exist or the value is larger
+// than the Room allows.
+func (r *Room) Set(iden, key, value string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.set(iden, key, value)
+}
+
+// SetAndNotify is like Set, but also returns how many waiters the write
+// satisfied: calls to GetWait waiting for the key inside of the session, and
+// calls to WaitForValue waiting for the key to hold the value. They're counted
+// as of the write, so a waiter whose ctx is done at the same time may still be
+// counted.
+func (r *Room) SetAndNotify(iden, key, value string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.set(iden, key, value); err != nil {
+		return 0, err
+	}
+	if _, ok := r.sessions[iden][key]; !ok {
+		// the value was a tombstone
+		return 0, nil
+	}
+
+	return r.keyWaiters[[2]string{iden, key}] + r.valWaiters[[2]string{key, value}], nil
+}
+
+// set is Set with the lock held by the caller.
+func (r *Room) set(iden, key, value string) error {
+	if err := r.writeCheck(iden); err != nil {
+		return err
+	}
+	if err := r.sizeCheck(value); err != nil {
+		return err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		return err
+	}
+
+	r.touch(iden)
+	r.write(iden, key, value)
+	r.changed(iden)
+
+	return nil
+}
+
+// SetBytes is like Set, but takes the value as a byte slice, such as a
+// serialized message. The bytes are copied into the Room, so v can be reused
+// once SetBytes returns. See GetBytes for how the value can be read back.
+func (r *Room) SetBytes(iden, key string, v []byte) error {
+	return r.Set(iden, key, string(v))
+}
+
+// SetChanged is like Set, but only writes the value if it's different from the
+// one already stored, returning whether it was written. Waiters on the session
+// are only woken by a write. The session's timer is reset either way.
+func (r *Room) SetChanged(iden, key, value string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return false, err
+	}
+	if err := r.sizeCheck(value); err != nil {
+		return false, err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		return false, err
+	}
+
+	r.touch(iden)
+	if old, ok := r.value(iden, key); ok && old == value {
+		return false, nil
+	} else if !ok && r.isTombstone(value) {
+		return false, nil
+	}
+	r.write(iden, key, value)
+	r.changed(iden)
+
+	return true, nil
+}
+
+// Swap stores the value param under the key param inside of the session
+// identified by the iden param, returning the value it replaced and whether
+// there was one.
+//
+// Swap returns an error if the session doesn't exist or the value is larger
+// than the Room allows.
+func (r *Room) Swap(iden, key, value string) (string, bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return "", false, err
+	}
+	if err := r.sizeCheck(value); err != nil {
+		return "", false, err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		return "", false, err
+	}
+
+	r.touch(iden)
+	old, existed := r.value(iden, key)
+	r.write(iden, key, value)
+	r.changed(iden)
+
+	return old, existed, nil
+}
+
+// UpdateKey calls fn with the value stored under the key param inside of the
+// session identified by the iden param, and whether there was one. The value fn
+// returns is stored under the key, or the key is deleted if fn returns true.
+// fn is called with the Room locked, so it must not use the Room.
+//
+// UpdateKey returns an error if the session doesn't exist, the new value is
+// larger than the Room allows, or fn returns one, in which case the session is
+// left unchanged.
+func (r *Room) UpdateKey(iden, key string, fn func(old string, existed bool) (string, bool, error)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		return err
+	}
+
+	old, existed := r.value(iden, key)
+	value, del, err := fn(old, existed)
+	if err != nil {
+		return err
+	}
+
+	if del {
+		r.erase(iden, key)
+	} else {
+		if err := r.sizeCheck(value); err != nil {
+			return err
+		}
+		r.store(iden, key, value)
+	}
+	r.touch(iden)
+	r.changed(iden)
+
+	return nil
+}
+
+// RenameKey moves the value stored under the oldKey param inside of the
+// session identified by the iden param to the newKey param. Renaming a key to
+// itself does nothing.
+//
+// RenameKey returns an error if the session or oldKey doesn't exist, or if
+// newKey already exists.
+func (r *Room) RenameKey(iden, oldKey, newKey string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return err
+	}
+	if err := r.keyCheck(iden, oldKey); err != nil {
+		return err
+	}
+	if err := r.schemaCheck(iden, newKey); err != nil {
+		return err
+	}
+
+	if oldKey == newKey {
+		r.touch(iden)
+		return nil
+	}
+	if _, ok := r.sessions[iden][newKey]; ok {
+		return keyError(ErrKeyExists, iden, newKey)
+	}
+
+	r.touch(iden)
+	value, _ := r.value(iden, oldKey)
+	r.erase(iden, oldKey)
+	r.store(iden, newKey, value)
+	r.changed(iden)
+
+	return nil
+}
+
+// Toggle flips the bool stored under the key param inside of the session
+// identified by the iden param, returning the new value. A key that doesn't
+// exist is treated as false, so the first Toggle stores "true".
+//
+// Toggle returns an error if the session doesn't exist or the stored value
+// can't be parsed as a bool.
+func (r *Room) Toggle(iden, key string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return false, err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		return false, err
+	}
+
+	var value bool
+
+	if stored, ok := r.value(iden, key); ok {
+		parsed, err := strconv.ParseBool(stored)
+		if err != nil {
+			return false, keyError(ErrNotABool, iden, key)
+		}
+		value = parsed
+	}
+
+	r.touch(iden)
+	r.store(iden, key, strconv.FormatBool(!value))
+	r.changed(iden)
+
+	return !value, nil
+}
+
+// IncrementBounded adds delta to the integer stored under the key param inside
+// of the session identified by the iden param, keeping the result between min
+// and max inclusive, and returns it. A result out of bounds is clamped to the
+// nearest bound, or wraps around to the other end of the bounds if the wrap
+// param is true, which suits round-robin indices. A key that doesn't exist is
+// treated as 0.
+//
+// IncrementBounded returns an error if the session doesn't exist, the stored
+// value can't be parsed as an integer, or min is greater than max.
+func (r *Room) IncrementBounded(iden, key string, delta, min, max int64, wrap bool) (int64, error) {
+	if min > max {
+		return 0, fmt.Errorf("%w: min %d, max %d", ErrInvalidBounds, min, max)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return 0, err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		return 0, err
+	}
+
+	var value int64
+
+	if stored, ok := r.value(iden, key); ok {
+		parsed, err := strconv.ParseInt(stored, 10, 64)
+		if err != nil {
+			return 0, keyError(ErrNotAnInt, iden, key)
+		}
+		value = parsed
+	}
+
+	// big.Int keeps the sum and range size from overflowing
+	var (
+		sum = new(big.Int).Add(big.NewInt(value), big.NewInt(delta))
+		lo  = big.NewInt(min)
+		hi  = big.NewInt(max)
+	)
+
+	switch {
+	case wrap:
+		size := new(big.Int).Sub(hi, lo)
+		size.Add(size, big.NewInt(1))
+		sum.Sub(sum, lo).Mod(sum, size).Add(sum, lo)
+	case sum.Cmp(lo) < 0:
+		sum = lo
+	case sum.Cmp(hi) > 0:
+		sum = hi
+	}
+	value = sum.Int64()
+
+	r.touch(iden)
+	r.store(iden, key, strconv.FormatInt(value, 10))
+	r.changed(iden)
+
+	return value, nil
+}
+
+// IncrementWithLimit adds delta to the integer stored under the key param
+// inside of the session identified by the iden param and returns the result.
+// If the result reaches the limit param, the session is deleted instead, with
+// ReasonLimit, and the bool is true. This suits counters such as failed logins
+// that should end the session once they're exceeded. A key that doesn't exist
+// is treated as 0.
+//
+// IncrementWithLimit returns an error if the session doesn't exist or the
+// stored value can't be parsed as an integer.
+func (r *Room) IncrementWithLimit(iden, key string, delta, limit int64) (int64, bool, error) {
+	r.mutex.Lock()
+	if err := r.writeCheck(iden); err != nil {
+		r.mutex.Unlock()
+		return 0, false, err
+	}
+	if err := r.schemaCheck(iden, key); err != nil {
+		r.mutex.Unlock()
+		return 0, false, err
+	}
+
+	var value int64
+
+	if stored, ok := r.value(iden, key); ok {
+		parsed, err := strconv.ParseInt(stored, 10, 64)
+		if err != nil {
+			r.mutex.Unlock()
+			return 0, false, keyError(ErrNotAnInt, iden, key)
+		}
+		value = parsed
+	}
+	value += delta
+
+	if value < limit {
+		r.touch(iden)
+		r.store(iden, key, strconv.FormatInt(value, 10))
+		r.changed(iden)
+		r.mutex.Unlock()
+		return value, false, nil
+	}
+
+	expire := r.track(r.drop(iden, ReasonLimit))
+	r.mutex.Unlock()
+
+	expire()
+
+	return value, true, nil
+}
+
+// TakeToken takes a token from a token bucket stored inside of the session
+// identified by the iden param, returning whether one was available. The bucket
+// holds up to burst tokens and is refilled at rate tokens per second. Its token
+// count is stored under the tokensKey param and the time it was last refilled
+// under the tsKey param, as Unix nanoseconds. If either key doesn't exist, the
+// bucket starts out full.
+//
+// TakeToken returns an error if the session doesn't exist or either key holds
+// a value that can't be parsed.
+func (r *Room) TakeToken(iden, tokensKey, tsKey string, rate float64, burst int) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return false, err
+	}
+	for _, key := range []string{tokensKey, tsKey} {
+		if err := r.schemaCheck(iden, key); err != nil {
+			return false, err
+		}
+	}
+
+	var (
+		now    = time.Now()
+		tokens = float64(burst)
+	)
+
+	storedTokens, hasTokens := r.value(iden, tokensKey)
+	storedTs, hasTs := r.value(iden, tsKey)
+	if hasTokens && hasTs {
+		parsed, err := strconv.ParseFloat(storedTokens, 64)
+		if err != nil {
+			return false, keyError(ErrNotANumber, iden, tokensKey)
+		}
+		nanos, err := strconv.ParseInt(storedTs, 10, 64)
+		if err != nil {
+			return false, keyError(ErrNotAnInt, iden, tsKey)
+		}
+
+		tokens = parsed + now.Sub(time.Unix(0, nanos)).Seconds()*rate
+		if tokens > float64(burst) {
+			tokens = float64(burst)
+		}
+	}
+
+	took := tokens >= 1
+	if took {
+		tokens--
+	}
+
+	r.touch(iden)
+	r.store(iden, tokensKey, strconv.FormatFloat(tokens, 'f', -1, 64))
+	r.store(iden, tsKey, strconv.FormatInt(now.UnixNano(), 10))
+	r.changed(iden)
+
+	return took, nil
+}
+
+// History returns the last changes made to the keys of the session identified
+// by the iden param, oldest first. It's always empty unless the Room was
+// created with WithKeyHistory.
+//
+// History returns an error if the session doesn't exist.
+func (r *Room) History(iden string) ([]Change, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return nil, err
+	}
+
+	history := make([]Change, len(r.history[iden]))
+	copy(history, r.history[iden])
+
+	return history, nil
+}
+
+// KeyModified returns when the value stored under the key param inside of the
+// session identified by the iden param was last written. Reading the value
+// doesn't change it, and neither does KeyModified touch the session.
+//
+// KeyModified returns an error if the session or key doesn't exist.
+func (r *Room) KeyModified(iden, key string) (time.Time, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.keyCheck(iden, key); err != nil {
+		return time.Time{}, err
+	}
+
+	return r.modified[iden][key], nil
+}
+
+// CreationStack returns the stack trace of the goroutine that created the
+// session identified by the iden param, which helps find the code responsible
+// for leaked sessions. It's always empty unless the Room was created with
+// WithCreationStacks. A session renamed by Rotate keeps its original stack.
+//
+// CreationStack returns an error if the session doesn't exist.
+func (r *Room) CreationStack(iden string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return "", err
+	}
+
+	return r.stacks[iden], nil
+}
+
+// KeyCount returns how many key-value pairs the session identified by the iden
+// param holds.
+//
+// KeyCount returns an error if the session doesn't exist.
+func (r *Room) KeyCount(iden string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return 0, err
+	}
+
+	return len(r.sessions[iden]), nil
+}
+
+// SizeBytes returns the combined length in bytes of every key and value inside
+// of the session identified by the iden param.
+//
+// SizeBytes returns an error if the session doesn't exist.
+func (r *Room) SizeBytes(iden string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return 0, err
+	}
+
+	size := 0
+	for k := range r.sessions[iden] {
+		v, _ := r.value(iden, k)
+		size += len(k) + len(v)
+	}
+
+	return size, nil
+}
+
+// DuplicateValues returns the values held by more than one key inside of the
+// session identified by the iden param, each mapped to the sorted keys holding
+// it. It returns an empty map if every value is unique.
+//
+// DuplicateValues returns an error if the session doesn't exist.
+func (r *Room) DuplicateValues(iden string) (map[string][]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]string)
+	for k, v := range r.values(iden) {
+		keys[v] = append(keys[v], k)
+	}
+
+	for v := range keys {
+		if len(keys[v]) < 2 {
+			delete(keys, v)
+			continue
+		}
+		sort.Strings(keys[v])
+	}
+
+	return keys, nil
+}
+
+// IsEmpty returns whether the Room holds no sessions.
+func (r *Room) IsEmpty() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.sessions) == 0
+}
+
+// WaitUntilBelow waits until the Room holds fewer than n sessions, waking up
+// only when sessions are removed. It returns immediately if there already are.
+//
+// WaitUntilBelow returns an error if ctx is done first.
+func (r *Room) WaitUntilBelow(ctx context.Context, n int) error {
+	for {
+		r.mutex.Lock()
+		if r.closed {
+			r.mutex.Unlock()
+			return ErrRoomClosed
+		}
+		if len(r.sessions) < n {
+			r.mutex.Unlock()
+			return nil
+		}
+
+		if r.removals == nil {
+			r.removals = make(chan struct{})
+		}
+		removals := r.removals
+		r.mutex.Unlock()
+
+		select {
+		case <-removals:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// KeyHistogram returns how many sessions hold each key found in the Room.
+func (r *Room) KeyHistogram() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	histogram := make(map[string]int)
+
+	for _, session := range r.sessions {
+		for k := range session {
+			histogram[k]++
+		}
+	}
+
+	return histogram
+}
+
+// AgeHistogram counts the sessions in the Room by how long ago they were
+// created. The buckets param holds the upper bounds of the buckets in
+// ascending order, and the count at each index is of the sessions younger than
+// that bound but not the one before it. The returned slice has one more count
+// than there are bounds, for sessions older than all of them.
+func (r *Room) AgeHistogram(buckets []time.Duration) []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var (
+		counts = make([]int, len(buckets)+1)
+		now    = time.Now()
+	)
+
+	for _, createdAt := range r.createdAt {
+		age := now.Sub(createdAt)
+		counts[sort.Search(len(buckets), func(i int) bool { return age < buckets[i] })]++
+	}
+
+	return counts
+}
+
+// FindSessions returns copies of every session holding the value param under
+// the key param, mapped by their idens. The returned maps aren't shared with
+// the Room, so they're safe to modify. It returns an empty map if no sessions
+// match.
+func (r *Room) FindSessions(key, value string) map[string]map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	found := make(map[string]map[string]string)
+
+	for iden := range r.sessions {
+		if v, ok := r.value(iden, key); !ok || v != value {
+			continue
+		}
+		found[iden] = r.values(iden)
+	}
+
+	return found
+}
+
+// Count returns how many sessions fn reports true for. fn is called with each
+// session's iden and a copy of its key-value pairs, taken all at once, after
+// the Room has been unlocked, so it's safe to use the Room from inside of it.
+// Sessions aren't touched.
+func (r *Room) Count(fn func(iden string, values map[string]string) bool) int {
+	r.mutex.Lock()
+	sessions := make(map[string]map[string]string, len(r.sessions))
+	for iden := range r.sessions {
+		sessions[iden] = r.values(iden)
+	}
+	r.mutex.Unlock()
+
+	n := 0
+	for iden, values := range sessions {
+		if fn(iden, values) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// PeekKeyAll returns the value held under the key param by every session that
+// has it, mapped by their idens. Like the Room's other reporting methods, it
+// doesn't count as activity, so it never keeps sessions alive.
+func (r *Room) PeekKeyAll(key string) map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	values := make(map[string]string)
+
+	for iden := range r.sessions {
+		if v, ok := r.value(iden, key); ok {
+			values[iden] = v
+		}
+	}
+
+	return values
+}
+
+// GetMatrix returns the values held under the keys param by each of the
+// sessions identified by the idens param, all read at once. Sessions that don't
+// exist are left out, as are keys a session doesn't have. Like PeekKeyAll, it
+// doesn't count as activity, so it never keeps sessions alive.
+//
+// GetMatrix returns ErrRoomClosed if the Room is closed.
+func (r *Room) GetMatrix(idens, keys []string) (map[string]map[string]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, ErrRoomClosed
+	}
+
+	matrix := make(map[string]map[string]string)
+
+	for _, iden := range idens {
+		if _, ok := r.sessions[iden]; !ok {
+			continue
+		}
+		values := make(map[string]string)
+		for _, k := range keys {
+			if v, ok := r.value(iden, k); ok {
+				values[k] = v
+			}
+		}
+		matrix[iden] = values
+	}
+
+	return matrix, nil
+}
+
+// ExpiringWithin returns the idens of sessions that will expire in less than d
+// unless there's more activity on them. It returns an empty slice if there
+// aren't any.
+func (r *Room) ExpiringWithin(d time.Duration) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var (
+		idens = make([]string, 0)
+		now   = time.Now()
+	)
+
+	for iden, deadline := range r.deadlines {
+		if r.rounded(deadline.Sub(now)) < d {
+			idens = append(idens, iden)
+		}
+	}
+
+	return idens
+}
+
+// CreatedSince returns the idens of sessions created less than d ago. Sessions
+// renamed by Rotate count from when they were first created. It returns an
+// empty slice if there aren't any.
+func (r *Room) CreatedSince(d time.Duration) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var (
+		idens = make([]string, 0)
+		now   = time.Now()
+	)
+
+	for iden, createdAt := range r.createdAt {
+		if now.Sub(createdAt) < d {
+			idens = append(idens, iden)
+		}
+	}
+
+	return idens
+}
+
+// RecentlyExpired returns when the session identified by the iden param
+// expired, if it did so recently enough that the Room still remembers it, so
+// that users can be told their session timed out rather than that it never
+// existed. It always returns false unless the Room was created with
+// WithExpiryTombstones, and for sessions removed by other means than expiring,
+// such as Del. Adding a session with the same iden forgets that it expired.
+func (r *Room) RecentlyExpired(iden string) (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	expired, ok := r.expired[iden]
+	return expired, ok
+}
+
+// NextExpiry returns how long the session closest to expiring has left to
+// live. It returns false if the Room is empty.
+func (r *Room) NextExpiry() (time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var (
+		next  time.Time
+		found bool
+	)
+	for _, deadline := range r.deadlines {
+		if !found || deadline.Before(next) {
+			next, found = deadline, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+
+	return r.rounded(time.Until(next)), true
+}
+
+// SessionsByTTL returns information about every session in the Room, ordered
+// by how long they have left to live. The sessions closest to expiring are
+// first.
+func (r *Room) SessionsByTTL() []SessionInfo {
+	r.mutex.Lock()
+	var (
+		infos = make([]SessionInfo, 0, len(r.deadlines))
+		now   = time.Now()
+	)
+	for iden := range r.deadlines {
+		info := r.info(iden, now)
+		info.TTL = r.rounded(info.TTL)
+		infos = append(infos, info)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].TTL < infos[j].TTL })
+
+	return infos
+}
+
+// TouchAll resets the timer of every session in the Room, as if each of them
+// had just been accessed.
+func (r *Room) TouchAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for iden := range r.sessions {
+		r.touch(iden)
+	}
+}
+
+// Reap removes every session whose lifetime has passed without waiting for its
+// timer, returning how many were removed. The expiry callbacks are called with
+// ReasonIdle before Reap returns.
+func (r *Room) Reap() int {
+	r.mutex.Lock()
+	if r.frozen {
+		r.mutex.Unlock()
+		return 0
+	}
+	var (
+		expires []func()
+		now     = time.Now()
+	)
+	for iden, deadline := range r.deadlines {
+		if deadline.After(now) {
+			continue
+		}
+		if r.deleteGuard != nil && !r.deleteGuard(iden, ReasonIdle) {
+			r.watch(iden, r.lifetimes[iden])
+			continue
+		}
+		expires = append(expires, r.track(r.drop(iden, ReasonIdle)))
+	}
+	r.mutex.Unlock()
+
+	for _, expire := range expires {
+		expire()
+	}
+
+	return len(expires)
+}
+
+// FlushExpiry is like Reap, but also waits for the expiry callbacks of sessions
+// removed elsewhere, such as by the Reaper or Del, to return, so that every
+// callback of a session that has expired is known to have completed. It's meant
+// for shutting down. Callbacks of sessions removed while FlushExpiry waits are
+// waited for as well, so it must not be called from an expiry callback.
+func (r *Room) FlushExpiry() int {
+	n := r.Reap()
+
+	r.mutex.Lock()
+	for r.expiring > 0 {
+		r.settled.Wait()
+	}
+	r.mutex.Unlock()
+
+	return n
+}
+
+// Compact rebuilds the maps the Room keeps for its sessions. Go maps never give
+// back the memory they grew to hold, so a Room that once held many more
+// sessions than it does now can call Compact to release it. Sessions and their
+// timers are unaffected, but the Room is locked while every map is copied.
+func (r *Room) Compact() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sessions = compacted(r.sessions)
+	r.watchers = compacted(r.watchers)
+	r.deadlines = compacted(r.deadlines)
+	r.lifetimes = compacted(r.lifetimes)
+	r.hooks = compacted(r.hooks)
+	r.tags = compacted(r.tags)
+	r.created = compacted(r.created)
+	r.creators = compacted(r.creators)
+	r.changes = compacted(r.changes)
+	r.groups = compacted(r.groups)
+	r.groupOf = compacted(r.groupOf)
+	r.compressed = compacted(r.compressed)
+	r.softDeleted = compacted(r.softDeleted)
+	r.history = compacted(r.history)
+	r.migrated = compacted(r.migrated)
+	r.reserved = compacted(r.reserved)
+	r.ciphers = compacted(r.ciphers)
+	r.modified = compacted(r.modified)
+	r.stacks = compacted(r.stacks)
+	r.createdAt = compacted(r.createdAt)
+	r.accessed = compacted(r.accessed)
+	r.expired = compacted(r.expired)
+	r.versions = compacted(r.versions)
+	r.removed = compacted(r.removed)
+}
+
+// compacted returns a copy of m sized for the entries it holds now.
+func compacted[V any](m map[string]V) map[string]V {
+	c := make(map[string]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// Tag labels the session identified by the iden param with the tags params.
+// Tags are kept apart from the session's key-value pairs and can be used to
+// delete groups of sessions with DelByTag.
+//
+// Tag returns an error if the session doesn't exist.
+func (r *Room) Tag(iden string, tags ...string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return err
+	}
+
+	if _, ok := r.tags[iden]; !ok {
+		r.tags[iden] = make(map[string]struct{}, len(tags))
+	}
+	for _, tag := range tags {
+		r.tags[iden][tag] = struct{}{}
+	}
+
+	return nil
+}
+
+// Tags returns the tags of the session identified by the iden param, sorted.
+//
+// Tags returns an error if the session doesn't exist.
+func (r *Room) Tags(iden string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(r.tags[iden]))
+	for tag := range r.tags[iden] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
+
+// DelByTag deletes every session labeled with the tag param, returning how many
+// were deleted. The expiry callbacks are called with ReasonManual.
+func (r *Room) DelByTag(tag string) (int, error) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return 0, ErrRoomClosed
+	}
+	if r.frozen {
+		r.mutex.Unlock()
+		return 0, ErrFrozen
+	}
+	var expires []func()
+	for iden, tags := range r.tags {
+		if _, ok := tags[tag]; ok {
+			expires = append(expires, r.track(r.drop(iden, ReasonManual)))
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, expire := range expires {
+		expire()
+	}
+
+	return len(expires), nil
+}
+
+// Group adds the sessions identified by the idens params to the group
+// identified by the groupID param, creating the group if needed. Activity on
+// any session in a group resets the timers of all of them, and they expire
+// together once any of their lifetimes passes without activity on the group.
+// A session can only be in one group, so it's moved out of any group it was
+// already in.
+//
+// Group returns an error if one of the sessions doesn't exist, in which case
+// no sessions are grouped.
+func (r *Room) Group(groupID string, idens ...string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return ErrRoomClosed
+	}
+	if len(idens) == 0 {
+		return nil
+	}
+	for _, iden := range idens {
+		if err := r.accessCheck(iden); err != nil {
+			return err
+		}
+	}
+
+	for _, iden := range idens {
+		r.ungroup(iden)
+		if _, ok := r.groups[groupID]; !ok {
+			r.groups[groupID] = make(map[string]struct{}, len(idens))
+		}
+		r.groups[groupID][iden] = struct{}{}
+		r.groupOf[iden] = groupID
+	}
+	r.touch(idens[0])
+
+	return nil
+}
+
+// ungroup removes the session from its group, deleting the group if it's left
+// empty. The caller must hold the lock.
+func (r *Room) ungroup(iden string) {
+	group, ok := r.groupOf[iden]
+	if !ok {
+		return
+	}
+
+	delete(r.groups[group], iden)
+	if len(r.groups[group]) == 0 {
+		delete(r.groups, group)
+	}
+	delete(r.groupOf, iden)
+}
+
+// DelGroup deletes every session in the group identified by the groupID param,
+// returning how many were deleted. The expiry callbacks are called with
+// ReasonManual.
+func (r *Room) DelGroup(groupID string) (int, error) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return 0, ErrRoomClosed
+	}
+	if r.frozen {
+		r.mutex.Unlock()
+		return 0, ErrFrozen
+	}
+	var expires []func()
+	for iden := range r.groups[groupID] {
+		expires = append(expires, r.track(r.drop(iden, ReasonManual)))
+	}
+	r.mutex.Unlock()
+
+	for _, expire := range expires {
+		expire()
+	}
+
+	return len(expires), nil
+}
+
+// Rotate moves the session identified by the oldIden param to the newIden
+// param, keeping its key-value pairs, key history, expiry hook, tags and group.
+// Unlike deleting and re-adding the session, the time it has left to live is
+// kept exactly. This allows session idens to be changed on privilege changes
+// without extending their life.
+//
+// Rotate returns an error if the old session doesn't exist or the new one
+// couldn't be created.
+func (r *Room) Rotate(oldIden, newIden string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(oldIden); err != nil {
+		return err
+	}
+	if err := r.createCheck(newIden); err != nil {
+		return err
+	}
+
+	var (
+		left            = time.Until(r.deadlines[oldIden])
+		session         = r.sessions[oldIden]
+		lifetime        = r.lifetimes[oldIden]
+		hook            = r.hooks[oldIden]
+		tags            = r.tags[oldIden]
+		compressed      = r.compressed[oldIden]
+		modified        = r.modified[oldIden]
+		history         = r.history[oldIden]
+		_, migrated     = r.migrated[oldIden]
+		stack, traced   = r.stacks[oldIden]
+		createdAt       = r.createdAt[oldIden]
+		accessed        = r.accessed[oldIden]
+		aead, encrypted = r.ciphers[oldIden]
+		group, inGroup  = r.groupOf[oldIden]
+	)
+
+	// the old session's callbacks aren't called, as it lives on
+	r.drop(oldIden, ReasonManual)
+
+	r.create(newIden)
+	r.sessions[newIden] = session
+	r.lifetimes[newIden] = lifetime
+	if hook != nil {
+		r.hooks[newIden] = hook
+	}
+	if tags != nil {
+		r.tags[newIden] = tags
+	}
+	if compressed != nil {
+		r.compressed[newIden] = compressed
+	}
+	if encrypted {
+		r.ciphers[newIden] = aead
+	}
+	if modified != nil {
+		r.modified[newIden] = modified
+	}
+	if history != nil {
+		r.history[newIden] = history
+	}
+	if migrated {
+		r.migrated[newIden] = struct{}{}
+	}
+	if traced {
+		r.stacks[newIden] = stack
+	}
+	r.createdAt[newIden] = createdAt
+	r.accessed[newIden] = accessed
+	if inGroup {
+		if _, ok := r.groups[group]; !ok {
+			r.groups[group] = make(map[string]struct{})
+		}
+		r.groups[group][newIden] = struct{}{}
+		r.groupOf[newIden] = group
+	}
+	r.watch(newIden, left)
+
+	return nil
+}
+
+// SoftDel deletes the session identified by the iden param, but keeps its
+// key-value pairs and expiry hook so it can be brought back by Restore within
+// the grace param. Until then the session doesn't exist as far as any other
+// method is concerned, and a new session can be added with the same iden. Once
+// the grace period passes, the session is gone for good and the expiry
+// callbacks are called with ReasonManual.
+//
+// SoftDel returns an error if the session doesn't exist.
+func (r *Room) SoftDel(iden string, grace time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writeCheck(iden); err != nil {
+		return err
+	}
+
+	deleted := &softDeleted{
+		values: r.values(iden),
+		hook:   r.hooks[iden],
+		aead:   r.ciphers[iden],
+	}
+	deleted.timer = time.AfterFunc(grace, func() { r.purge(iden, deleted) })
+
+	// the callbacks are called once the session is purged
+	r.drop(iden, ReasonManual)
+	r.softDeleted[iden] = deleted
+
+	return nil
+}
+
+// Restore brings back the session identified by the iden param after it was
+// deleted by SoftDel, with a new lifetime.
+//
+// Restore returns an error if the session wasn't soft deleted or its grace
+// period has passed, or if a session with that iden was added since.
+func (r *Room) Restore(iden string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return sessionError(ErrRoomClosed, iden)
+	}
+	deleted, ok := r.softDeleted[iden]
+	if !ok {
+		return sessionError(ErrDoesntExist, iden)
+	}
+	if err := r.createCheck(iden); err != nil {
+		return err
+	}
+
+	deleted.timer.Stop()
+	delete(r.softDeleted, iden)
+
+	r.create(iden)
+	if deleted.aead != nil {
+		r.ciphers[iden] = deleted.aead
+	}
+	for k, v := range deleted.values {
+		r.store(iden, k, v)
+	}
+	if deleted.hook != nil {
+		r.hooks[iden] = deleted.hook
+	}
+	r.watch(iden, r.lifetimes[iden])
+
+	return nil
+}
+
+// purge forgets a soft deleted session once its grace period has passed.
+func (r *Room) purge(iden string, deleted *softDeleted) {
+	r.mutex.Lock()
+	if r.softDeleted[iden] != deleted {
+		// restored, or soft deleted again since
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.softDeleted, iden)
+	onExpire := r.onExpire
+	r.mutex.Unlock()
+
+	for _, fn := range onExpire {
+		(*fn)(iden, ReasonManual)
+	}
+	if deleted.hook != nil {
+		deleted.hook()
+	}
+}
+
+// ReplaceAll deletes every session in the Room and adds copies of the sessions
+// param in their place, all at once, so the Room is never seen partly
+// replaced. The new sessions start with a full lifetime. The expiry callbacks
+// of the deleted sessions are called with ReasonReplaced.
+//
+// ReplaceAll returns an error if the Room is frozen or one of the new sessions
+// has an iden the Room won't accept, such as a reserved one or one it doesn't
+// own, or too large a value, in which case the Room is left unchanged.
+func (r *Room) ReplaceAll(sessions map[string]map[string]string) error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRoomClosed
+	}
+	if r.frozen {
+		r.mutex.Unlock()
+		return ErrFrozen
+	}
+	for iden, values := range sessions {
+		if err := r.idenCheck(iden); err != nil {
+			r.mutex.Unlock()
+			return err
+		}
+		for _, v := range values {
+			if err := r.sizeCheck(v); err != nil {
+				r.mutex.Unlock()
+				return err
+			}
+		}
+	}
+
+	expires := make([]func(), 0, len(r.sessions))
+	for iden := range r.sessions {
+		expires = append(expires, r.track(r.drop(iden, ReasonReplaced)))
+	}
+	for iden, values := range sessions {
+		r.create(iden)
+		for k, v := range values {
+			r.store(iden, k, v)
+		}
+		r.watch(iden, r.lifetimes[iden])
+	}
+	r.mutex.Unlock()
+
+	for _, expire := range expires {
+		expire()
+	}
+
+	return nil
+}
+
+// Freeze stops the Room from being changed until Unfreeze is called, so that a
+// consistent copy of it can be taken. While frozen, anything that would add,
+// change or delete a session returns ErrFrozen, while reads keep working.
+//
+// Sessions don't expire while the Room is frozen. A session whose lifetime
+// passes during the freeze is given another lifetime instead.
+func (r *Room) Freeze() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.frozen = true
+}
+
+// Unfreeze allows the Room to be changed again after a call to Freeze.
+func (r *Room) Unfreeze() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.frozen = false
+}
+
+// Close deletes every session in the Room, without calling their expiry
+// callbacks, and stops the Room's goroutines. Its Reaper is only stopped if it
+// isn't shared. Callbacks already running or queued by WithExpiryWorkers are
+// still called, and waiters such as GetWait, WaitForValue and WaitCreate are
+// woken.
+//
+// Once closed, every method of the Room that can fail returns ErrRoomClosed,
+// and the rest behave as if the Room is empty. Close returns ErrRoomClosed if
+// the Room was already closed.
+func (r *Room) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return ErrRoomClosed
+	}
+
+	for iden := range r.sessions {
+		// the callbacks aren't called
+		r.drop(iden, ReasonManual)
+	}
+	for iden, deleted := range r.softDeleted {
+		deleted.timer.Stop()
+		delete(r.softDeleted, iden)
+	}
+	for iden, timer := range r.reserved {
+		timer.Stop()
+		delete(r.reserved, iden)
+	}
+	if r.stores != nil {
+		close(r.stores)
+		r.stores = nil
+	}
+	if r.removals != nil {
+		close(r.removals)
+		r.removals = nil
+	}
+	for iden, created := range r.created {
+		close(created)
+		delete(r.created, iden)
+		delete(r.creators, iden)
+	}
+	r.closed = true
+
+	if r.ownsReaper {
+		r.reaper.stop()
+	}
+	if r.expiryPool != nil {
+		r.expiryPool.stop()
+	}
+	if r.audit != nil {
+		close(r.audit.notify)
+	}
+	for stream := range r.streams {
+		close(stream.notify)
+		delete(r.streams, stream)
+	}
+
+	return nil
+}
+
+// CloseContext is like Close, but then waits for the Room to shut down: for
+// expiry callbacks that are running or queued to return, for the session
+// watchers to stop, and for the Room's Reaper to stop if it isn't shared. No
+// new work is accepted while it waits, as the Room is already closed.
+//
+// CloseContext returns ctx.Err() if ctx is done before the Room has shut down,
+// which includes waiting for the lock to close the Room while a function such
+// as UpdateKey's fn holds it. The Room is then still closed, once it can be,
+// and whatever is still running is left to finish in the background. It
+// returns ErrRoomClosed if the Room was already closed.
+func (r *Room) CloseContext(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		if err := r.Close(); err != nil {
+			done <- err
+			return
+		}
+
+		r.mutex.Lock()
+		for r.expiring > 0 {
+			r.settled.Wait()
+		}
+		r.mutex.Unlock()
+
+		r.watching.Wait()
+		if r.ownsReaper {
+			<-r.reaper.exited
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Clone returns a new Room holding copies of the Room's sessions, each with
+// the same time left to live, and configured with the same options. The two
+// Rooms share nothing, apart from a Reaper given by WithSharedReaper, so
+// changes to one never affect the other. It's meant for tests that start from
+// a known state and branch off.
+//
+// Functions added by OnExpire and SetExpiryHook aren't carried over, nor are
+// soft deleted sessions, reservations, or the audit log given by WithAuditLog,
+// so the clone's changes aren't written to it.
+func (r *Room) Clone() *Room {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	clone := NewRoom(r.dispatcher.lifetime)
+
+	clone.mutex.Lock()
+	defer clone.mutex.Unlock()
+
+	clone.dispatcher.jitter = r.dispatcher.jitter
+	clone.dispatcher.warning = r.dispatcher.warning
+	if !r.ownsReaper {
+		clone.reaper.stop()
+		clone.reaper, clone.ownsReaper = r.reaper, false
+	}
+	if r.createLimit != nil {
+		clone.createLimit = newLimiter(int(r.createLimit.n), r.createLimit.per)
+	}
+	if r.expiryPool != nil {
+		clone.expiryPool = newExpiryPool(r.expiryPool.workers)
+	}
+	clone.maxValueBytes = r.maxValueBytes
+	clone.loader = r.loader
+	clone.idenSource = r.idenSource
+	clone.coalesce = r.coalesce
+	clone.frozen = r.frozen
+	clone.idenValidator = r.idenValidator
+	clone.compressAbove = r.compressAbove
+	clone.auditValues = r.auditValues
+	clone.historySize = r.historySize
+	clone.migrator = r.migrator
+	clone.reserveFor = r.reserveFor
+	clone.onWarning = r.onWarning
+	clone.tombstone = r.tombstone
+	clone.traceCreation = r.traceCreation
+	clone.shardFunc = r.shardFunc
+	clone.minReset = r.minReset
+	clone.factory = r.factory
+	clone.policy = r.policy
+	clone.schema = r.schema
+	clone.strictSchema = r.strictSchema
+	clone.onUnknownKey = r.onUnknownKey
+	clone.tombstoneTTL = r.tombstoneTTL
+	clone.deleteGuard = r.deleteGuard
+	clone.granularity = r.granularity
+
+	for iden := range r.sessions {
+		clone.create(iden)
+		clone.lifetimes[iden] = r.lifetimes[iden]
+		clone.createdAt[iden] = r.createdAt[iden]
+		clone.accessed[iden] = r.accessed[iden]
+		if aead, ok := r.ciphers[iden]; ok {
+			clone.ciphers[iden] = aead
+		}
+		for k, v := range r.values(iden) {
+			clone.store(iden, k, v)
+		}
+		for k, modified := range r.modified[iden] {
+			clone.modified[iden][k] = modified
+		}
+		if history, ok := r.history[iden]; ok {
+			clone.history[iden] = append([]Change(nil), history...)
+		}
+		if tags, ok := r.tags[iden]; ok {
+			clone.tags[iden] = make(map[string]struct{}, len(tags))
+			for tag := range tags {
+				clone.tags[iden][tag] = struct{}{}
+			}
+		}
+		if stack, ok := r.stacks[iden]; ok {
+			clone.stacks[iden] = stack
+		}
+		if _, ok := r.migrated[iden]; ok {
+			clone.migrated[iden] = struct{}{}
+		}
+	}
+	for group, members := range r.groups {
+		clone.groups[group] = make(map[string]struct{}, len(members))
+		for iden := range members {
+			clone.groups[group][iden] = struct{}{}
+			clone.groupOf[iden] = group
+		}
+	}
+	for iden := range r.sessions {
+		clone.watch(iden, time.Until(r.deadlines[iden]))
+	}
+
+	return clone
+}
+
+// Iterator walks through the sessions of a Room in batches. It's weakly
+// consistent: sessions added after it was created aren't seen, and sessions
+// removed before their batch is reached are skipped.
+type Iterator struct {
+	room  *Room
+	idens []string
+	size  int
+}
+
+// SessionView is a copy of a session's key-value pairs taken by View. It never
+// changes, so it's safe to use from multiple goroutines at once.
+type SessionView struct {
+	values map[string]string
+}
+
+// Get returns the value stored under the key param, and whether there was one.
+func (v *SessionView) Get(key string) (string, bool) {
+	value, ok := v.values[key]
+	return value, ok
+}
+
+// Keys returns the keys of the view in sorted order.
+func (v *SessionView) Keys() []string {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns how many key-value pairs the view holds.
+func (v *SessionView) Len() int {
+	return len(v.values)
+}
+
+// View returns a SessionView of the session identified by the iden param as it
+// is now, which later writes to the session don't affect. It suits long
+// computations over a session that make many lookups, as the Room is only
+// locked while the copy is taken. The session is touched.
+//
+// View returns an error if the session doesn't exist.
+func (r *Room) View(iden string) (*SessionView, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.migrate(iden)
+	if err := r.accessCheck(iden); err != nil {
+		return nil, err
+	}
+
+	r.touch(iden)
+
+	return &SessionView{values: r.values(iden)}, nil
+}
+
+// Iterator returns an Iterator over the sessions in the Room, which returns up
+// to size sessions from each call to Next. The Room is only locked while
+// creating the Iterator and during each call to Next, so large Rooms can be
+// walked through without blocking other operations for long.
+func (r *Room) Iterator(size int) *Iterator {
+	r.mutex.Lock()
+	idens := make([]string, 0, len(r.sessions))
+	for iden := range r.sessions {
+		idens = append(idens, iden)
+	}
+	r.mutex.Unlock()
+
+	sort.Strings(idens)
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &Iterator{room: r, idens: idens, size: size}
+}
+
+// Next returns the next batch of sessions, or false once every session has
+// been returned.
+func (it *Iterator) Next() ([]SessionInfo, bool) {
+	if len(it.idens) == 0 {
+		return nil, false
+	}
+
+	n := it.size
+	if n > len(it.idens) {
+		n = len(it.idens)
+	}
+	idens := it.idens[:n]
+	it.idens = it.idens[n:]
+
+	it.room.mutex.Lock()
+	defer it.room.mutex.Unlock()
+
+	var (
+		infos = make([]SessionInfo, 0, len(idens))
+		now   = time.Now()
+	)
+	for _, iden := range idens {
+		if _, ok := it.room.deadlines[iden]; ok {
+			info := it.room.info(iden, now)
+			info.TTL = it.room.rounded(info.TTL)
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, true
+}
+
+// Del deletes the session specified by the iden parameter. It returns an error
+// if the session doesn't exist or the Room's delete guard keeps it.
+func (r *Room) Del(iden string) error {
+	return r.remove(iden, ReasonManual, nil)
+}
+
+// CompareAndDel deletes the session identified by the iden param, but only if
+// it holds the expected param under the key param, returning whether it was
+// deleted. Checking a marker this way avoids deleting a session that was
+// removed and added again since it was last seen.
+//
+// CompareAndDel returns an error if the session doesn't exist or the Room is
+// frozen.
+func (r *Room) CompareAndDel(iden, key, expected string) (bool, error) {
+	r.mutex.Lock()
+	if err := r.writeCheck(iden); err != nil {
+		r.mutex.Unlock()
+		return false, err
+	}
+	if value, ok := r.value(iden, key); !ok || value != expected {
+		r.mutex.Unlock()
+		return false, nil
+	}
+	expire := r.track(r.drop(iden, ReasonManual))
+	r.mutex.Unlock()
+
+	expire()
+
+	return true, nil
+}
+
+// OnExpire adds a function to be called whenever a session is removed from the
+// Room, along with the reason for the removal. Any number of functions can be
+// added, and they're called one after the other in the order they were added.
+// They're called without the Room locked, so it's safe to use the Room from
+// inside of them.
+//
+// OnExpire returns a func that removes fn again. Removals that have already
+// begun may still call fn.
+func (r *Room) OnExpire(fn func(iden string, reason Reason)) func() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	registered := &fn
+
+	// the slice is copied on every change, as removals in progress hold on to
+	// the one they started with
+	r.onExpire = append(r.onExpire[:len(r.onExpire):len(r.onExpire)], registered)
+
+	return func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		onExpire := make([]*func(string, Reason), 0, len(r.onExpire))
+		for _, f := range r.onExpire {
+			if f != registered {
+				onExpire = append(onExpire, f)
+			}
+		}
+		r.onExpire = onExpire
+	}
+}
+
+// SetExpiryHook sets a function called when the session specified by the iden
+// param is removed from the Room. It's called after the OnExpire functions,
+// and also without the Room locked.
+//
+// SetExpiryHook returns an error if the session doesn't exist.
+func (r *Room) SetExpiryHook(iden string, fn func()) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return err
+	}
+
+	r.hooks[iden] = fn
+
+	return nil
+}
+
+// remove deletes the session and calls the expiry callback with the reason. If
+// the watcher param isn't nil, the session is only deleted if it's still
+// watched by it, as the watcher may have been replaced or stopped since it
+// fired. An idle session is only deleted if its deadline has passed, as it may
+// have been used while the kill waited on the Reaper.
+func (r *Room) remove(iden string, reason Reason, watcher chan struct{}) error {
+	r.mutex.Lock()
+	if err := r.accessCheck(iden); err != nil {
+		r.mutex.Unlock()
+		return err
+	}
+	if watcher != nil && r.watchers[iden] != watcher {
+		r.mutex.Unlock()
+		return sessionError(ErrDoesntExist, iden)
+	}
+	if left := time.Until(r.deadlines[iden]); reason == ReasonIdle && left > 0 {
+		// the watcher is gone, so another one waits out the time left
+		r.watch(iden, left)
+		r.mutex.Unlock()
+		return nil
+	}
+	if r.frozen {
+		// expiry is paused, so the session gets another lifetime
+		if reason == ReasonIdle {
+			r.watch(iden, r.lifetimes[iden])
+		}
+		r.mutex.Unlock()
+		return sessionError(ErrFrozen, iden)
+	}
+
+	// grouped sessions expire together
+	idens := []string{iden}
+	if group, ok := r.groupOf[iden]; ok && reason == ReasonIdle {
+		idens = idens[:0]
+		for member := range r.groups[group] {
+			idens = append(idens, member)
+		}
+	}
+
+	if r.deleteGuard != nil {
+		for _, member := range idens {
+			if r.deleteGuard(member, reason) {
+				continue
+			}
+			// an expired session gets another lifetime
+			if reason == ReasonIdle {
+				r.watch(iden, r.lifetimes[iden])
+			}
+			r.mutex.Unlock()
+			return sessionError(ErrVetoed, member)
+		}
+	}
+
+	expires := make([]func(), len(idens))
+	for i, iden := range idens {
+		expires[i] = r.track(r.drop(iden, reason))
+	}
+	r.mutex.Unlock()
+
+	for _, expire := range expires {
+		if r.expiryPool != nil && reason == ReasonIdle {
+			r.expiryPool.add(expire)
+			continue
+		}
+		expire()
+	}
+
+	return nil
+}
+
+// entomb remembers that the session expired now, and forgets it once the
+// Room's tombstone TTL has passed. The caller must hold the lock.
+func (r *Room) entomb(iden string) {
+	now := time.Now()
+	r.expired[iden] = now
+
+	time.AfterFunc(r.tombstoneTTL, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		// the session may have expired again since
+		if r.expired[iden].Equal(now) {
+			delete(r.expired, iden)
+		}
+	})
+}
+
+// track counts the expiry callbacks in flight until expire has been called, so
+// that FlushExpiry and CloseContext can wait for them. The caller must hold the
+// lock, and must call the returned func after releasing it.
+func (r *Room) track(expire func()) func() {
+	r.expiring++
+
+	return func() {
+		expire()
+
+		r.mutex.Lock()
+		if r.expiring--; r.expiring == 0 {
+			r.settled.Broadcast()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// drop deletes everything the Room holds for the session and returns a func
+// that calls its expiry callbacks. The caller must hold the lock, and must call
+// the returned func after releasing it.
+func (r *Room) drop(iden string, reason Reason) func() {
+	onExpire, hook := r.onExpire, r.hooks[iden]
+
+	if watcher, ok := r.watchers[iden]; ok {
+		close(watcher)
+	}
+
+	delete(r.sessions, iden)
+	delete(r.watchers, iden)
+	delete(r.deadlines, iden)
+	delete(r.lifetimes, iden)
+	delete(r.hooks, iden)
+	delete(r.tags, iden)
+	delete(r.compressed, iden)
+	delete(r.ciphers, iden)
+	delete(r.modified, iden)
+	delete(r.stacks, iden)
+	delete(r.createdAt, iden)
+	delete(r.accessed, iden)
+	delete(r.history, iden)
+	delete(r.migrated, iden)
+	delete(r.versions, iden)
+	r.version++
+	if r.checkpoints {
+		r.removed[iden] = r.version
+	}
+	r.ungroup(iden)
+	r.changed(iden)
+	if r.removals != nil {
+		close(r.removals)
+		r.removals = nil
+	}
+	r.record(auditEntry{Op: "del", Iden: iden, Reason: reason.String()})
+	if r.tombstoneTTL > 0 && reason == ReasonIdle {
+		r.entomb(iden)
+	}
+
+	return func() {
+		for _, fn := range onExpire {
+			(*fn)(iden, reason)
+		}
+		if hook != nil {
+			hook()
+		}
+	}
+}
+
+// touch resets the timer of the session, and of every session grouped with
+// it. The caller must hold the lock.
+func (r *Room) touch(iden string) {
+	if group, ok := r.groupOf[iden]; ok {
+		for member := range r.groups[group] {
+			r.refresh(member)
+		}
+		return
+	}
+	r.refresh(iden)
+}
+
+// refresh resets the session's timer. It never waits on the watcher, as pings
+// are buffered and a ping that's already pending makes another one redundant.
+// Resets closer together than the Room's minimum reset interval are ignored.
+// The caller must hold the lock.
+func (r *Room) refresh(iden string) {
+	if r.minReset > 0 && time.Since(r.accessed[iden]) < r.minReset {
+		return
+	}
+	r.accessed[iden] = time.Now()
+
+	if !r.coalesce && r.policy == nil {
+		select {
+		case r.watchers[iden] <- struct{}{}:
+		default:
+			// a ping is already pending, and it resets the timer all the same
+		}
+	}
+	r.deadlines[iden] = r.deadline(iden, r.lifetimes[iden])
+}
+
+// deadline returns when the session should expire if it has the left param to
+// live, unless the Room's expiry policy decides otherwise. The policy isn't
+// consulted while the Room is frozen. The caller must hold the lock.
+func (r *Room) deadline(iden string, left time.Duration) time.Time {
+	now := time.Now()
+	if r.policy == nil || r.frozen {
+		return now.Add(left)
+	}
+	return r.policy(r.info(iden, now))
+}
+
+// rounded rounds the TTL to the Room's TTL granularity, if any, for reporting.
+func (r *Room) rounded(ttl time.Duration) time.Duration {
+	if r.granularity <= 0 {
+		return ttl
+	}
+	return ttl.Round(r.granularity)
+}
+
+// info describes the session as of now. The TTL is zero if the session's
+// watcher hasn't been started yet. The caller must hold the lock.
+func (r *Room) info(iden string, now time.Time) SessionInfo {
+	info := SessionInfo{
+		Iden:       iden,
+		CreatedAt:  r.createdAt[iden],
+		LastAccess: r.accessed[iden],
+	}
+	if deadline, ok := r.deadlines[iden]; ok {
+		info.TTL = deadline.Sub(now)
+	}
+	return info
+}
+
+// bump marks the session as changed since every checkpoint taken so far. The
+// caller must hold the lock.
+func (r *Room) bump(iden string) {
+	r.version++
+	r.versions[iden] = r.version
+}
+
+// changed wakes everything waiting for the session to change. The caller must
+// hold the lock.
+func (r *Room) changed(iden string) {
+	if changes, ok := r.changes[iden]; ok {
+		close(changes)
+		delete(r.changes, iden)
+	}
+}
+
+// wait adds delta to the number of waiters for the target, which is an iden and
+// key for GetWait, or a key and value for WaitForValue. The caller must hold
+// the lock.
+func (r *Room) wait(waiters map[[2]string]int, target [2]string, delta int) {
+	if waiters[target] += delta; waiters[target] == 0 {
+		delete(waiters, target)
+	}
+}
+
+// nextChange returns a channel that's closed the next time the session changes
+// or is removed. The caller must hold the lock.
+func (r *Room) nextChange(iden string) <-chan struct{} {
+	if _, ok := r.changes[iden]; !ok {
+		r.changes[iden] = make(chan struct{})
+	}
+	return r.changes[iden]
+}
+
+// migrate upgrades the session with the Room's migrator the first time it's
+// read. It does nothing if the session doesn't exist or the Room is frozen.
+// The caller must hold the lock.
+func (r *Room) migrate(iden string) {
+	if r.migrator == nil || r.frozen {
+		return
+	}
+	if _, ok := r.sessions[iden]; !ok {
+		return
+	}
+	if _, ok := r.migrated[iden]; ok {
+		return
+	}
+	r.migrated[iden] = struct{}{}
+
+	values, changed := r.migrator(iden, r.values(iden))
+	if !changed {
+		return
+	}
+
+	for k := range r.sessions[iden] {
+		r.erase(iden, k)
+	}
+	for k, v := range values {
+		r.store(iden, k, v)
+	}
+	r.changed(iden)
+}
+
+// value returns the value stored under the key inside of the session,
+// decrypting and decompressing it if needed. The caller must hold the lock.
+func (r *Room) value(iden, key string) (string, bool) {
+	value, ok := r.sessions[iden][key]
+	if !ok {
+		return "", false
+	}
+	if aead, ok := r.ciphers[iden]; ok {
+		value = decrypt(aead, value)
+	}
+	if _, ok := r.compressed[iden][key]; ok {
+		value = decompress(value)
+	}
+	return value, true
+}
+
+// values returns a copy of the session's key-value pairs, decrypting and
+// decompressing values if needed. The caller must hold the lock.
+func (r *Room) values(iden string) map[string]string {
+	values := make(map[string]string, len(r.sessions[iden]))
+	for k := range r.sessions[iden] {
+		values[k], _ = r.value(iden, k)
+	}
+	return values
+}
+
+// store stores the value under the key inside of the session. The value is
+// compressed if it's over the Room's compression threshold and compression
+// makes it smaller, and then encrypted if the session has a key. The caller
+// must hold the lock.
+func (r *Room) store(iden, key, value string) {
+	if r.historySize > 0 {
+		old, _ := r.value(iden, key)
+		r.remember(iden, key, old, value)
+	}
+
+	stored := value
+
+	delete(r.compressed[iden], key)
+	if r.compressAbove > 0 && len(value) > r.compressAbove {
+		if compressed := compress(value); len(compressed) < len(value) {
+			if _, ok := r.compressed[iden]; !ok {
+				r.compressed[iden] = make(map[string]struct{})
+			}
+			r.compressed[iden][key] = struct{}{}
+			stored = compressed
+		}
+	}
+	if aead, ok := r.ciphers[iden]; ok {
+		stored = encrypt(aead, stored)
+	}
+
+	r.sessions[iden][key] = stored
+	r.bump(iden)
+	if r.stores != nil {
+		close(r.stores)
+		r.stores = nil
+	}
+	if _, ok := r.modified[iden]; !ok {
+		r.modified[iden] = make(map[string]time.Time)
+	}
+	r.modified[iden][key] = time.Now()
+	r.record(auditEntry{Op: "set", Iden: iden, Key: key, Value: &value})
+}
+
+// write stores the value under the key inside of the session, or deletes the
+// key if the value is the Room's tombstone. The caller must hold the lock.
+func (r *Room) write(iden, key, value string) {
+	if r.isTombstone(value) {
+		r.erase(iden, key)
+		return
+	}
+	r.store(iden, key, value)
+}
+
+func (r *Room) isTombstone(value string) bool {
+	return r.tombstone != nil && *r.tombstone == value
+}
+
+// erase deletes the key from the session. The caller must hold the lock.
+func (r *Room) erase(iden, key string) {
+	if r.historySize > 0 {
+		old, _ := r.value(iden, key)
+		r.remember(iden, key, old, "")
+	}
+
+	delete(r.sessions[iden], key)
+	r.bump(iden)
+	delete(r.compressed[iden], key)
+	delete(r.modified[iden], key)
+	r.record(auditEntry{Op: "delkey", Iden: iden, Key: key})
+}
+
+// remember adds a change to the session's history, dropping the oldest change
+// if the history is full. The caller must hold the lock.
+func (r *Room) remember(iden, key, old, value string) {
+	history := append(r.history[iden], Change{
+		Key:  key,
+		Old:  old,
+		New:  value,
+		Time: time.Now(),
+	})
+	if len(history) > r.historySize {
+		history = history[len(history)-r.historySize:]
+	}
+	r.history[iden] = history
+}
+
+// AuditErr returns the first error from writing to the audit log given by
+// WithAuditLog, or nil if there hasn't been one or the Room has no audit log.
+func (r *Room) AuditErr() error {
+	if r.audit == nil {
+		return nil
+	}
+
+	r.audit.mutex.Lock()
+	defer r.audit.mutex.Unlock()
+
+	return r.audit.err
+}
+
+// record adds the entry to the Room's audit log, if it has one. The caller must
+// hold the lock.
+func (r *Room) record(entry auditEntry) {
+	if r.audit == nil && len(r.streams) == 0 {
+		return
+	}
+
+	entry.Time = time.Now()
+	if !r.auditValues {
+		entry.Value = nil
+	}
+	if r.audit != nil {
+		r.audit.add(entry)
+	}
+	for stream := range r.streams {
+		stream.add(entry)
+	}
+}
+
+func compress(value string) string {
+	var (
+		buf    bytes.Buffer
+		writer = gzip.NewWriter(&buf)
+	)
+
+	// writes to a bytes.Buffer don't fail
+	writer.Write([]byte(value))
+	writer.Close()
+
+	return buf.String()
+}
+
+func encrypt(aead cipher.AEAD, value string) string {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return string(aead.Seal(nonce, nonce, []byte(value), nil))
+}
+
+func decrypt(aead cipher.AEAD, value string) string {
+	nonce, sealed := value[:aead.NonceSize()], value[aead.NonceSize():]
+
+	opened, err := aead.Open(nil, []byte(nonce), []byte(sealed), nil)
+	if err != nil {
+		panic("gosh: corrupt encrypted value: " + err.Error())
+	}
+
+	return string(opened)
+}
+
+func decompress(value string) string {
+	reader, err := gzip.NewReader(strings.NewReader(value))
+	if err != nil {
+		panic("gosh: corrupt compressed value: " + err.Error())
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		panic("gosh: corrupt compressed value: " + err.Error())
+	}
+
+	return string(decompressed)
+}
+
+// remaining returns how long the session has left to live, or zero if it
+// doesn't exist.
+func (r *Room) remaining(iden string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	deadline, ok := r.deadlines[iden]
+	if !ok {
+		return 0
+	}
+
+	return time.Until(deadline)
+}
+
+// Snapshot returns copies of every session in the Room, mapped by their idens,
+// all taken at once. Sessions aren't touched.
+func (r *Room) Snapshot() map[string]map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	snapshot := make(map[string]map[string]string, len(r.sessions))
+	for iden := range r.sessions {
+		snapshot[iden] = r.values(iden)
+	}
+
+	return snapshot
+}
+
+// DiffFrom compares the Room against the snapshot param, usually taken earlier
+// by Snapshot. It returns the sorted idens of sessions added and removed since,
+// and the sorted keys that were added, removed or changed inside of each
+// session found in both, for sessions with any. Sessions aren't touched.
+func (r *Room) DiffFrom(snapshot map[string]map[string]string) ([]string, []string, map[string][]string) {
+	current := r.Snapshot()
+
+	var (
+		added   = make([]string, 0)
+		removed = make([]string, 0)
+		changed = make(map[string][]string)
+	)
+
+	for iden, values := range current {
+		old, ok := snapshot[iden]
+		if !ok {
+			added = append(added, iden)
+			continue
+		}
+		if keys := diffKeys(old, values); len(keys) > 0 {
+			changed[iden] = keys
+		}
+	}
+	for iden := range snapshot {
+		if _, ok := current[iden]; !ok {
+			removed = append(removed, iden)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed, changed
+}
+
+// diffKeys returns the sorted keys whose values differ between a and b,
+// including keys only one of them has.
+func diffKeys(a, b map[string]string) []string {
+	var keys []string
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Checkpoint returns a token for the Room's current state, to be passed to
+// ChangedSince later on. From the first call on, the Room remembers the idens
+// of removed sessions so ChangedSince can report them, until they're forgotten
+// by Forget.
+func (r *Room) Checkpoint() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.checkpoints = true
+
+	return r.version
+}
+
+// Forget forgets the sessions removed up to the Checkpoint call that returned
+// the token param, which should be the oldest token still to be passed to
+// ChangedSince. Removals before it are then left out of what ChangedSince
+// reports for older tokens.
+func (r *Room) Forget(token uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for iden, version := range r.removed {
+		if version <= token {
+			delete(r.removed, iden)
+		}
+	}
+}
+
+// ChangedSince returns the sessions that have been added or changed since the
+// Checkpoint call that returned the token param, along with the idens of the
+// sessions removed since then. It's meant for incremental backups: applying
+// both to a copy taken at the checkpoint brings the copy up to date. A session
+// removed and then added again is only reported as changed.
+//
+// Removals are only reported once Checkpoint has been called. The Room then
+// remembers the iden of every removed session until Forget is called with a
+// token taken after the removal, or a session with the same iden is added
+// again, so incremental backups should call Forget once they're done with a
+// token.
+func (r *Room) ChangedSince(token uint64) (map[string]map[string]string, []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed := make(map[string]map[string]string)
+	for iden, version := range r.versions {
+		if version > token {
+			changed[iden] = r.values(iden)
+		}
+	}
+
+	removed := make([]string, 0)
+	for iden, version := range r.removed {
+		if version > token {
+			removed = append(removed, iden)
+		}
+	}
+	sort.Strings(removed)
+
+	return changed, removed
+}
+
+// ExportCSV writes every session in the Room to w as CSV. Each row starts with
+// the session iden followed by the values of the keys param, in order. Keys
+// that don't exist inside a session are written as empty strings. Rows are
+// ordered by iden.
+//
+// The sessions are copied while the Room is locked, so writing to w doesn't
+// block other operations on the Room.
+func (r *Room) ExportCSV(w io.Writer, keys []string) error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRoomClosed
+	}
+	rows := make([][]string, 0, len(r.sessions))
+	for iden := range r.sessions {
+		row := make([]string, len(keys)+1, len(keys)+1)
+		row[0] = iden
+		for i, k := range keys {
+			row[i+1], _ = r.value(iden, k)
+		}
+		rows = append(rows, row)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append([]string{"iden"}, keys...)); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ExportEnv returns the key-value pairs of the session identified by the iden
+// param as "key=value" entries sorted by key, ready for exec.Cmd's Env. Values
+// are used as they are, including any newlines or "=" signs. Keys that are
+// empty or contain "=", and keys or values that contain a NUL byte, can't be
+// passed to a process, so those pairs are left out. The session is touched.
+//
+// ExportEnv returns an error if the session doesn't exist.
+func (r *Room) ExportEnv(iden string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.accessCheck(iden); err != nil {
+		return nil, err
+	}
+
+	r.touch(iden)
+
+	keys := make([]string, 0, len(r.sessions[iden]))
+	for k := range r.sessions[iden] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v, _ := r.value(iden, k)
+		if k == "" || strings.ContainsAny(k, "=\x00") || strings.ContainsRune(v, 0) {
+			continue
+		}
+		env = append(env, k+"="+v)
+	}
+
+	return env, nil
+}
+
+// StreamChanges writes a line of JSON to w for every change made to the Room
+// until ctx is done, in the same format as WithAuditLog: the time, the op, the
+// session iden and the key, if any. Values are only included if the Room was
+// created with WithAuditValues. Changes are queued without limit while w is
+// being written to, so a slow w never slows down the Room. Any number of
+// streams can run at once.
+//
+// StreamChanges returns ctx.Err() once ctx is done, the first error from
+// writing to w, or ErrRoomClosed once the Room is closed and the changes
+// leading up to it have been written.
+func (r *Room) StreamChanges(ctx context.Context, w io.Writer) error {
+	stream := newAuditLog(w)
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRoomClosed
+	}
+	r.streams[stream] = struct{}{}
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.streams, stream)
+		r.mutex.Unlock()
+	}()
+
+	encoder := json.NewEncoder(w)
+
+	for {
+		select {
+		case _, ok := <-stream.notify:
+			stream.mutex.Lock()
+			pending := stream.pending
+			stream.pending = nil
+			stream.mutex.Unlock()
+
+			for _, entry := range pending {
+				if err := encoder.Encode(entry); err != nil {
+					return err
+				}
+			}
+			if !ok {
+				return ErrRoomClosed
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ActiveWatchers returns how many watcher goroutines are running for the Room.
+// In a healthy Room it's the same as the number of sessions, apart from
+// watchers that have fired and are waiting for their session to be removed.
+func (r *Room) ActiveWatchers() int {
+	return int(r.active.Load())
+}
+
+// StuckKills returns how many of the Room's expired sessions have been waiting
+// for its Reaper to remove them for longer than ten seconds. The Reaper removes
+// sessions one at a time, so a count that stays above zero means it's wedged,
+// usually by an expiry callback that never returns, and sessions are piling up
+// instead of being removed.
+func (r *Room) StuckKills() int {
+	return int(r.stuckKills.Load())
+}
+
+// ReapOrphans removes sessions that don't have a watcher and watchers that
+// don't have a session, returning how many orphans were removed. In a healthy
+// Room it always returns 0. The expiry callbacks of orphaned sessions are
+// called with ReasonIdle before ReapOrphans returns.
+func (r *Room) ReapOrphans() int {
+	r.mutex.Lock()
+	var (
+		expires []func()
+		reaped  int
+	)
+	for iden := range r.sessions {
+		if _, ok := r.watchers[iden]; !ok {
+			expires = append(expires, r.track(r.drop(iden, ReasonIdle)))
+		}
+	}
+	for iden := range r.watchers {
+		if _, ok := r.sessions[iden]; !ok {
+			close(r.watchers[iden])
+			delete(r.watchers, iden)
+			reaped++
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, expire := range expires {
+		expire()
+	}
+
+	return reaped + len(expires)
+}
+
+// storedSession is how WriteTo writes a session.
+type storedSession struct {
+	Iden   string
+	Values map[string]string
+	TTL    time.Duration
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes every session in the Room to w using encoding/gob, along with
+// how long each session has left to live. The sessions can be read back with
+// ReadFrom. It returns the number of bytes written.
+func (r *Room) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return 0, ErrRoomClosed
+	}
+	var (
+		stored = make([]storedSession, 0, len(r.sessions))
+		now    = time.Now()
+	)
+	for iden := range r.sessions {
+		stored = append(stored, storedSession{
+			Iden:   iden,
+			Values: r.values(iden),
+			TTL:    r.deadlines[iden].Sub(now),
+		})
+	}
+	r.mutex.Unlock()
+
+	counter := &countingWriter{w: w}
+	err := gob.NewEncoder(counter).Encode(stored)
+
+	return counter.n, err
+}
+
+// ReadFrom adds the sessions written by WriteTo to the Room. Each session gets
+// a new watcher with the time it had left to live when it was written, and
+// sessions that had already expired are skipped. It returns the number of
+// bytes read.
+//
+// ReadFrom returns an error if the sessions can't be decoded or one of them
+// already exists in the Room, in which case no sessions are added.
+func (r *Room) ReadFrom(rd io.Reader) (int64, error) {
+	r.mutex.Lock()
+	closed := r.closed
+	r.mutex.Unlock()
+	if closed {
+		return 0, ErrRoomClosed
+	}
+
+	var (
+		counter = &countingReader{r: rd}
+		stored  []storedSession
+	)
+	if err := gob.NewDecoder(counter).Decode(&stored); err != nil {
+		return counter.n, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, session := range stored {
+		if err := r.createCheck(session.Iden); err != nil {
+			return counter.n, err
+		}
+	}
+
+	for _, session := range stored {
+		if session.TTL <= 0 {
+			continue
+		}
+		r.create(session.Iden)
+		for k, v := range session.Values {
+			r.store(session.Iden, k, v)
+		}
+		r.watch(session.Iden, session.TTL)
+	}
+
+	return counter.n, nil
 }
@@ -0,0 +1,2715 @@
+package gosh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRoom returns a Room that's closed once the test finishes.
+func newRoom(t testing.TB, lifetime time.Duration, opts ...Option) *Room {
+	t.Helper()
+
+	r := NewRoom(lifetime, opts...)
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+// waitFor fails the test if cond doesn't become true within a second.
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// exists reports whether the Room holds the session.
+func exists(r *Room, iden string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.sessions[iden]
+	return ok
+}
+
+// setTTL restarts the session's watcher with the ttl param left to live.
+func setTTL(r *Room, iden string, ttl time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.watch(iden, ttl)
+}
+
+// expiries collects the removals reported to OnExpire.
+type expiries struct {
+	mutex   sync.Mutex
+	reasons map[string]Reason
+	order   []string
+}
+
+func watchExpiries(r *Room) *expiries {
+	e := &expiries{reasons: make(map[string]Reason)}
+	r.OnExpire(func(iden string, reason Reason) {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+
+		e.reasons[iden] = reason
+		e.order = append(e.order, iden)
+	})
+	return e
+}
+
+func (e *expiries) reason(iden string) (Reason, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	reason, ok := e.reasons[iden]
+	return reason, ok
+}
+
+func (e *expiries) count() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return len(e.order)
+}
+
+// syncBuffer is a bytes.Buffer that's safe to write to from the audit log's
+// goroutine while the test reads it.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// entries parses the lines written to the buffer as audit entries.
+func (b *syncBuffer) entries(t testing.TB) []auditEntry {
+	t.Helper()
+
+	var entries []auditEntry
+	for _, line := range b.lines() {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestExportCSV(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("b")
+	r.Set("b", "name", "has,comma")
+	r.Set("b", "role", "admin")
+	r.Add("a")
+	r.Set("a", "name", "alice")
+
+	var buf bytes.Buffer
+	if err := r.ExportCSV(&buf, []string{"name", "role"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"iden", "name", "role"},
+		{"a", "alice", ""},
+		{"b", "has,comma", "admin"},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", rows, want)
+	}
+}
+
+func TestReapOrphans(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	e := watchExpiries(r)
+	r.Add("no-watcher")
+	r.Add("no-session")
+	r.Add("healthy")
+
+	r.mutex.Lock()
+	close(r.watchers["no-watcher"])
+	delete(r.watchers, "no-watcher")
+	delete(r.sessions, "no-session")
+	r.mutex.Unlock()
+
+	if n := r.ReapOrphans(); n != 2 {
+		t.Fatalf("got %d orphans, want 2", n)
+	}
+	if exists(r, "no-watcher") {
+		t.Fatal("session without a watcher wasn't removed")
+	}
+	if reason, ok := e.reason("no-watcher"); !ok || reason != ReasonIdle {
+		t.Fatalf("got reason %v, %v, want idle", reason, ok)
+	}
+	if !exists(r, "healthy") {
+		t.Fatal("healthy session was removed")
+	}
+	waitFor(t, func() bool { return r.ActiveWatchers() == 1 })
+	if n := r.ReapOrphans(); n != 0 {
+		t.Fatalf("got %d orphans in a healthy Room, want 0", n)
+	}
+}
+
+func TestExpiryReasons(t *testing.T) {
+	r := newRoom(t, 20*time.Millisecond)
+	e := watchExpiries(r)
+
+	r.Add("idle")
+	r.Add("manual")
+	r.Del("manual")
+	r.Add("limit")
+	r.IncrementWithLimit("limit", "failures", 3, 3)
+	waitFor(t, func() bool { return !exists(r, "idle") })
+	r.Add("replaced")
+	r.ReplaceAll(map[string]map[string]string{"new": {}})
+
+	want := map[string]Reason{
+		"idle":     ReasonIdle,
+		"manual":   ReasonManual,
+		"limit":    ReasonLimit,
+		"replaced": ReasonReplaced,
+	}
+	for iden, reason := range want {
+		waitFor(t, func() bool { _, ok := e.reason(iden); return ok })
+		if got, _ := e.reason(iden); got != reason {
+			t.Errorf("%s: got reason %v, want %v", iden, got, reason)
+		}
+		if got := reason.String(); got != iden {
+			t.Errorf("got %q, want %q", got, iden)
+		}
+	}
+	if got := Reason(-1).String(); got != "unknown" {
+		t.Errorf("got %q, want unknown", got)
+	}
+}
+
+func TestSetExpiryHook(t *testing.T) {
+	r := newRoom(t, time.Minute)
+
+	var (
+		mutex sync.Mutex
+		calls []string
+	)
+	r.OnExpire(func(iden string, reason Reason) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, "global "+iden)
+	})
+	r.Add("a")
+	if err := r.SetExpiryHook("a", func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, "hook")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r.Del("a")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := []string{"global a", "hook"}; fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", calls, want)
+	}
+
+	if err := r.SetExpiryHook("missing", func() {}); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestFindSessions(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+	r.Set("a", "role", "admin")
+	r.Set("a", "name", "alice")
+	r.Add("b")
+	r.Set("b", "role", "admin")
+	r.Set("b", "name", "bob")
+	r.Add("c")
+	r.Set("c", "role", "user")
+
+	found := r.FindSessions("role", "admin")
+	if len(found) != 2 || found["a"]["name"] != "alice" || found["b"]["name"] != "bob" {
+		t.Fatalf("got %v", found)
+	}
+
+	found["a"]["name"] = "mallory"
+	if name, _ := r.Get("a", "name"); name != "alice" {
+		t.Fatalf("changing the result changed the session to %q", name)
+	}
+
+	if found := r.FindSessions("role", "guest"); found == nil || len(found) != 0 {
+		t.Fatalf("got %v, want an empty map", found)
+	}
+}
+
+func TestNewRoomChecked(t *testing.T) {
+	for _, lifetime := range []time.Duration{0, -time.Second} {
+		r, err := NewRoomChecked(lifetime)
+		if !errors.Is(err, ErrInvalidLifetime) || r != nil {
+			t.Errorf("%v: got %v, %v, want ErrInvalidLifetime", lifetime, r, err)
+		}
+	}
+
+	r, err := NewRoomChecked(time.Minute)
+	if err != nil || r == nil {
+		t.Fatalf("got %v, %v, want a Room", r, err)
+	}
+	r.Close()
+}
+
+func TestExpiringWithin(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	for iden, ttl := range map[string]time.Duration{
+		"soon":   5 * time.Second,
+		"sooner": time.Second,
+		"later":  30 * time.Second,
+	} {
+		r.Add(iden)
+		setTTL(r, iden, ttl)
+	}
+
+	got := r.ExpiringWithin(10 * time.Second)
+	sort.Strings(got)
+	if want := []string{"soon", "sooner"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := r.ExpiringWithin(time.Millisecond); got == nil || len(got) != 0 {
+		t.Fatalf("got %v, want an empty slice", got)
+	}
+}
+
+func TestMaxValueBytes(t *testing.T) {
+	r := newRoom(t, time.Minute, WithMaxValueBytes(4))
+	r.Add("a")
+
+	if err := r.Set("a", "k", "abcd"); err != nil {
+		t.Fatalf("value at the limit: %v", err)
+	}
+	if err := r.Set("a", "k", "abcde"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("got %v, want ErrValueTooLarge", err)
+	}
+	if v, _ := r.Get("a", "k"); v != "abcd" {
+		t.Fatalf("got %q after a rejected Set, want abcd", v)
+	}
+}
+
+func TestSessionsByTTL(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	for iden, ttl := range map[string]time.Duration{
+		"a": 30 * time.Second,
+		"b": 10 * time.Second,
+		"c": 20 * time.Second,
+	} {
+		r.Add(iden)
+		setTTL(r, iden, ttl)
+	}
+
+	var idens []string
+	for _, info := range r.SessionsByTTL() {
+		idens = append(idens, info.Iden)
+	}
+	if want := []string{"b", "c", "a"}; fmt.Sprint(idens) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", idens, want)
+	}
+}
+
+func TestToggle(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	for _, want := range []bool{true, false, true} {
+		if got, err := r.Toggle("a", "flag"); err != nil || got != want {
+			t.Fatalf("got %v, %v, want %v", got, err, want)
+		}
+		if v, _ := r.Get("a", "flag"); v != strconv.FormatBool(want) {
+			t.Fatalf("stored %q, want %v", v, want)
+		}
+	}
+
+	r.Set("a", "flag", "maybe")
+	if _, err := r.Toggle("a", "flag"); !errors.Is(err, ErrNotABool) {
+		t.Fatalf("got %v, want ErrNotABool", err)
+	}
+	if _, err := r.Toggle("missing", "flag"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestReap(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	e := watchExpiries(r)
+	r.Add("expired")
+	r.Add("live")
+
+	r.mutex.Lock()
+	r.deadlines["expired"] = time.Now().Add(-time.Second)
+	r.mutex.Unlock()
+
+	if n := r.Reap(); n != 1 {
+		t.Fatalf("reaped %d, want 1", n)
+	}
+	if exists(r, "expired") || !exists(r, "live") {
+		t.Fatal("Reap removed the wrong sessions")
+	}
+	if reason, ok := e.reason("expired"); !ok || reason != ReasonIdle {
+		t.Fatalf("got reason %v, %v before Reap returned, want idle", reason, ok)
+	}
+}
+
+func TestTags(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+	r.Add("b")
+	r.Add("c")
+	r.Tag("a", "tenant=acme", "role=admin")
+	r.Tag("b", "tenant=acme")
+	r.Tag("c", "tenant=other")
+
+	if tags, _ := r.Tags("a"); fmt.Sprint(tags) != "[role=admin tenant=acme]" {
+		t.Fatalf("got %v", tags)
+	}
+	if n, err := r.DelByTag("tenant=acme"); n != 2 || err != nil {
+		t.Fatalf("got %d, %v, want 2", n, err)
+	}
+	if exists(r, "a") || exists(r, "b") || !exists(r, "c") {
+		t.Fatal("DelByTag removed the wrong sessions")
+	}
+	if err := r.Tag("missing", "x"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	var calls atomic.Int64
+	errLoad := errors.New("database is down")
+	r := newRoom(t, time.Minute, WithLoader(func(iden, key string) (string, bool, error) {
+		calls.Add(1)
+		switch key {
+		case "found":
+			return "loaded " + iden, true, nil
+		case "broken":
+			return "", false, errLoad
+		}
+		return "", false, nil
+	}))
+	r.Add("a")
+
+	for i := 0; i < 2; i++ {
+		if v, err := r.Get("a", "found"); v != "loaded a" || err != nil {
+			t.Fatalf("got %q, %v", v, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("loader called %d times, want 1 as the value is stored", n)
+	}
+	if _, err := r.Get("a", "missing"); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v, want ErrKeyDoesntExist", err)
+	}
+	if _, err := r.Get("a", "broken"); !errors.Is(err, errLoad) {
+		t.Fatalf("got %v, want the loader's error", err)
+	}
+	if _, err := r.Get("missing", "found"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestIdenSource(t *testing.T) {
+	n := 0
+	r := newRoom(t, time.Minute, WithIdenSource(func() string {
+		n++
+		return "iden-" + strconv.Itoa(n)
+	}))
+
+	for _, want := range []string{"iden-1", "iden-2"} {
+		if got, err := r.AddAuto(); got != want || err != nil {
+			t.Fatalf("got %q, %v, want %q", got, err, want)
+		}
+	}
+
+	iden, err := newRoom(t, time.Minute).AddAuto()
+	if err != nil || len(iden) != 32 {
+		t.Fatalf("got %q, %v, want 32 hex characters", iden, err)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	if old, existed, err := r.Swap("a", "state", "open"); old != "" || existed || err != nil {
+		t.Fatalf("got %q, %v, %v", old, existed, err)
+	}
+	if old, existed, err := r.Swap("a", "state", "closed"); old != "open" || !existed || err != nil {
+		t.Fatalf("got %q, %v, %v", old, existed, err)
+	}
+	if v, _ := r.Get("a", "state"); v != "closed" {
+		t.Fatalf("got %q, want closed", v)
+	}
+	if _, _, err := r.Swap("missing", "state", "open"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestCoalescedPings(t *testing.T) {
+	r := newRoom(t, 50*time.Millisecond, WithCoalescedPings())
+	r.Add("busy")
+	r.Set("busy", "k", "v")
+	r.Add("idle")
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		r.Get("busy", "k")
+	}
+	if !exists(r, "busy") {
+		t.Fatal("activity didn't keep the session alive")
+	}
+	waitFor(t, func() bool { return !exists(r, "idle") })
+	waitFor(t, func() bool { return !exists(r, "busy") })
+}
+
+func benchmarkGet(b *testing.B, opts ...Option) {
+	r := newRoom(b, time.Minute, opts...)
+	r.Add("a")
+	r.Set("a", "k", "v")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r.Get("a", "k")
+		}
+	})
+}
+
+func BenchmarkGetPinged(b *testing.B) { benchmarkGet(b) }
+
+func BenchmarkGetCoalesced(b *testing.B) { benchmarkGet(b, WithCoalescedPings()) }
+
+func TestWaitCreate(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	existing, _ := r.WaitCreate("a")
+	select {
+	case <-existing:
+	default:
+		t.Fatal("channel for an existing session isn't closed")
+	}
+
+	created, _ := r.WaitCreate("b")
+	go r.Add("b")
+	select {
+	case <-created:
+	case <-time.After(time.Second):
+		t.Fatal("waiter wasn't woken by Add")
+	}
+
+	// the channel is dropped once every waiter has given up on it
+	first, cancelFirst := r.WaitCreate("c")
+	_, cancelSecond := r.WaitCreate("c")
+	cancelFirst()
+	cancelFirst()
+	r.mutex.Lock()
+	left := r.creators["c"]
+	r.mutex.Unlock()
+	if left != 1 {
+		t.Fatalf("got %d waiters left, want 1", left)
+	}
+	cancelSecond()
+	r.mutex.Lock()
+	channels, counts := len(r.created), len(r.creators)
+	r.mutex.Unlock()
+	if channels != 0 || counts != 0 {
+		t.Fatalf("got %d channels and %d counts held, want none", channels, counts)
+	}
+	r.Add("c")
+	select {
+	case <-first:
+		t.Fatal("a given up channel was closed by Add")
+	default:
+	}
+}
+
+func TestCreateRateLimit(t *testing.T) {
+	r := newRoom(t, time.Minute, WithCreateRateLimit(2, 50*time.Millisecond))
+
+	r.Add("a")
+	r.Add("b")
+	if err := r.Add("c"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := r.Add("c"); err != nil {
+		t.Fatalf("got %v after the window, want nil", err)
+	}
+}
+
+func TestGetOrCreate(t *testing.T) {
+	r := newRoom(t, time.Minute)
+
+	values, created, err := r.GetOrCreate("a")
+	if err != nil || !created || len(values) != 0 {
+		t.Fatalf("got %v, %v, %v, want a new empty session", values, created, err)
+	}
+
+	r.Set("a", "k", "v")
+	values, created, err = r.GetOrCreate("a")
+	if err != nil || created || values["k"] != "v" {
+		t.Fatalf("got %v, %v, %v, want the existing session", values, created, err)
+	}
+	values["k"] = "changed"
+	if v, _ := r.Get("a", "k"); v != "v" {
+		t.Fatalf("changing the result changed the session to %q", v)
+	}
+}
+
+func TestLifetimeJitter(t *testing.T) {
+	const lifetime = time.Minute
+
+	lifetimes := func() []time.Duration {
+		r := newRoom(t, lifetime, WithLifetimeJitter(0.5), WithRandSource(rand.NewSource(1)))
+		var lifetimes []time.Duration
+		for i := 0; i < 20; i++ {
+			iden := strconv.Itoa(i)
+			r.Add(iden)
+			lifetimes = append(lifetimes, r.lifetimes[iden])
+		}
+		return lifetimes
+	}
+
+	first := lifetimes()
+	lo, hi := first[0], first[0]
+	for _, l := range first {
+		if l < lifetime/2 || l > lifetime*3/2 {
+			t.Fatalf("lifetime %v out of range", l)
+		}
+		if l < lo {
+			lo = l
+		}
+		if l > hi {
+			hi = l
+		}
+	}
+	if hi-lo < lifetime/4 {
+		t.Fatalf("lifetimes between %v and %v aren't spread out", lo, hi)
+	}
+	if second := lifetimes(); fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatal("the same rand source gave different lifetimes")
+	}
+}
+
+func TestAddWith(t *testing.T) {
+	r := newRoom(t, time.Minute, WithMaxValueBytes(8))
+
+	values := map[string]string{"a": "1", "b": "2"}
+	if err := r.AddWith("s", values); err != nil {
+		t.Fatal(err)
+	}
+	values["a"] = "changed"
+	if got, _ := r.GetBatch("s", "a", "b"); fmt.Sprint(got) != "[1 2]" {
+		t.Fatalf("got %v", got)
+	}
+
+	if err := r.AddWith("s", nil); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+	if err := r.AddWith("big", map[string]string{"k": "too large"}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("got %v, want ErrValueTooLarge", err)
+	}
+	if exists(r, "big") {
+		t.Fatal("session was created despite the error")
+	}
+}
+
+func TestKeyCountSizeBytes(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+	r.Set("a", "key", "value")
+	r.Set("a", "k", "")
+
+	if n, err := r.KeyCount("a"); n != 2 || err != nil {
+		t.Fatalf("got %d, %v, want 2", n, err)
+	}
+	if n, err := r.SizeBytes("a"); n != 9 || err != nil {
+		t.Fatalf("got %d, %v, want 9", n, err)
+	}
+	if _, err := r.KeyCount("missing"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+	if _, err := r.SizeBytes("missing"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestGetWait(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+	r.Set("a", "ready", "now")
+
+	ctx := context.Background()
+	if v, err := r.GetWait(ctx, "a", "ready"); v != "now" || err != nil {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Set("a", "other", "x")
+		r.Set("a", "later", "set")
+	}()
+	if v, err := r.GetWait(ctx, "a", "later"); v != "set" || err != nil {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.GetWait(timeout, "a", "never"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Del("a")
+	}()
+	if _, err := r.GetWait(ctx, "a", "never"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestSharedReaper(t *testing.T) {
+	reaper := NewReaper()
+
+	var rooms []*Room
+	var watched []*expiries
+	for i := 0; i < 3; i++ {
+		r := newRoom(t, 20*time.Millisecond, WithSharedReaper(reaper))
+		watched = append(watched, watchExpiries(r))
+		r.Add("shared")
+		r.Add("room-" + strconv.Itoa(i))
+		rooms = append(rooms, r)
+	}
+
+	// a closed Room is deregistered and its sessions never expire
+	rooms[2].Close()
+
+	for i, r := range rooms[:2] {
+		waitFor(t, func() bool { return r.IsEmpty() })
+		for _, iden := range []string{"shared", "room-" + strconv.Itoa(i)} {
+			waitFor(t, func() bool { _, ok := watched[i].reason(iden); return ok })
+		}
+		if n := watched[i].count(); n != 2 {
+			t.Fatalf("room %d saw %d expiries, want 2", i, n)
+		}
+	}
+	time.Sleep(40 * time.Millisecond)
+	if n := watched[2].count(); n != 0 {
+		t.Fatalf("closed room saw %d expiries, want 0", n)
+	}
+
+	// the Reaper keeps serving the Rooms still using it
+	rooms[0].Add("again")
+	waitFor(t, func() bool { return rooms[0].IsEmpty() })
+
+	for _, r := range rooms {
+		r.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		reaper.Close()
+		reaper.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reaper.Close didn't return")
+	}
+}
+
+func TestSetChanged(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	changes := func() <-chan struct{} {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return r.nextChange("a")
+	}
+	woken := func(c <-chan struct{}) bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+
+	c := changes()
+	if changed, err := r.SetChanged("a", "k", "v"); !changed || err != nil {
+		t.Fatalf("got %v, %v, a missing key should count as a change", changed, err)
+	}
+	if !woken(c) {
+		t.Fatal("a change didn't wake waiters")
+	}
+
+	c = changes()
+	if changed, err := r.SetChanged("a", "k", "v"); changed || err != nil {
+		t.Fatalf("got %v, %v for an unchanged value", changed, err)
+	}
+	if woken(c) {
+		t.Fatal("an unchanged value woke waiters")
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	if _, err := r.Get("a", ""); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v before setting the empty key, want ErrKeyDoesntExist", err)
+	}
+	if err := r.Set("a", "", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.Get("a", ""); v != "empty" || err != nil {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if n, _ := r.KeyCount("a"); n != 1 {
+		t.Fatalf("got %d keys, want 1", n)
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"n": "1"})
+
+	err := r.UpdateKey("a", "n", func(old string, existed bool) (string, bool, error) {
+		if old != "1" || !existed {
+			t.Fatalf("got %q, %v", old, existed)
+		}
+		return "2", false, nil
+	})
+	if v, _ := r.Get("a", "n"); err != nil || v != "2" {
+		t.Fatalf("got %q, %v, want 2", v, err)
+	}
+
+	errUpdate := errors.New("refused")
+	err = r.UpdateKey("a", "n", func(string, bool) (string, bool, error) {
+		return "3", false, errUpdate
+	})
+	if v, _ := r.Get("a", "n"); !errors.Is(err, errUpdate) || v != "2" {
+		t.Fatalf("got %q, %v, want the session unchanged and fn's error", v, err)
+	}
+
+	r.UpdateKey("a", "n", func(string, bool) (string, bool, error) {
+		return "", true, nil
+	})
+	if _, err := r.Get("a", "n"); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v, want the key deleted", err)
+	}
+
+	err = r.UpdateKey("missing", "n", func(string, bool) (string, bool, error) {
+		t.Fatal("fn called for a missing session")
+		return "", false, nil
+	})
+	if !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	r := newRoom(t, 20*time.Millisecond)
+	r.AddWith("a", map[string]string{"k": "v"})
+	r.Freeze()
+
+	if err := r.Set("a", "k", "w"); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("Set: got %v, want ErrFrozen", err)
+	}
+	if err := r.Add("b"); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("Add: got %v, want ErrFrozen", err)
+	}
+	if err := r.Del("a"); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("Del: got %v, want ErrFrozen", err)
+	}
+
+	// expiry is paused, so the session outlives several lifetimes
+	time.Sleep(100 * time.Millisecond)
+	if v, err := r.Get("a", "k"); v != "v" || err != nil {
+		t.Fatalf("got %q, %v while frozen", v, err)
+	}
+
+	r.Unfreeze()
+	if err := r.Set("a", "k", "w"); err != nil {
+		t.Fatalf("got %v after Unfreeze", err)
+	}
+	waitFor(t, func() bool { return !exists(r, "a") })
+}
+
+func TestAddOnce(t *testing.T) {
+	r := newRoom(t, time.Minute)
+
+	var (
+		wg  sync.WaitGroup
+		won atomic.Int64
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := r.AddOnce("leader")
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				won.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := won.Load(); n != 1 {
+		t.Fatalf("%d callers won, want 1", n)
+	}
+}
+
+func TestTouchAllParkedWatcher(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	for i := 0; i < 1000; i++ {
+		r.Add(strconv.Itoa(i))
+	}
+
+	// a watcher that never receives, as if it were stuck
+	r.mutex.Lock()
+	watcher := r.watchers["0"]
+	r.watchers["0"] = make(chan struct{})
+	r.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.TouchAll()
+		r.TouchAll()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("TouchAll blocked on a parked watcher")
+	}
+
+	r.mutex.Lock()
+	r.watchers["0"] = watcher
+	r.mutex.Unlock()
+}
+
+func TestKeyHistogram(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"user": "1", "cart": "x"})
+	r.AddWith("b", map[string]string{"user": "2"})
+	r.AddWith("c", map[string]string{"user": "3", "cart": "y", "theme": "dark"})
+
+	want := map[string]int{"user": 3, "cart": 2, "theme": 1}
+	if got := r.KeyHistogram(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestGetFull(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"k": "v"})
+
+	for _, test := range []struct {
+		iden, key         string
+		value             string
+		session, keyFound bool
+	}{
+		{"a", "k", "v", true, true},
+		{"a", "missing", "", true, false},
+		{"missing", "k", "", false, false},
+		{"missing", "missing", "", false, false},
+	} {
+		value, session, keyFound, err := r.GetFull(test.iden, test.key)
+		if err != nil || value != test.value || session != test.session || keyFound != test.keyFound {
+			t.Errorf("%s, %s: got %q, %v, %v, %v", test.iden, test.key, value, session, keyFound, err)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	r := newRoom(t, 50*time.Millisecond)
+	for _, iden := range []string{"a", "b", "c", "d", "e"} {
+		r.AddWith(iden, map[string]string{"k": "v"})
+	}
+	if err := r.Group("ab", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	r.Group("cd", "c", "d")
+	if err := r.Group("x", "a", "missing"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+
+	// activity on a keeps b alive, while c and d expire together
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		r.Get("a", "k")
+	}
+	if !exists(r, "b") {
+		t.Fatal("touching a didn't keep b alive")
+	}
+	waitFor(t, func() bool { return !exists(r, "c") && !exists(r, "d") })
+
+	if n, err := r.DelGroup("ab"); n != 2 || err != nil {
+		t.Fatalf("got %d, %v, want 2", n, err)
+	}
+	if exists(r, "a") || exists(r, "b") {
+		t.Fatal("DelGroup left members behind")
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"k": "v", "": "empty"})
+	r.AddWith("b", nil)
+	setTTL(r, "b", 10*time.Second)
+
+	var buf bytes.Buffer
+	written, err := r.WriteTo(&buf)
+	if err != nil || written != int64(buf.Len()) {
+		t.Fatalf("got %d, %v, want %d bytes", written, err, buf.Len())
+	}
+
+	loaded := newRoom(t, time.Minute)
+	read, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes()))
+	if err != nil || read != written {
+		t.Fatalf("got %d, %v, want %d bytes", read, err, written)
+	}
+	if got, _ := loaded.GetBatch("a", "k", ""); fmt.Sprint(got) != "[v empty]" {
+		t.Fatalf("got %v, want the values read back", got)
+	}
+
+	loaded.mutex.Lock()
+	ttl := time.Until(loaded.deadlines["b"])
+	watchers := len(loaded.watchers)
+	loaded.mutex.Unlock()
+	if ttl > 10*time.Second {
+		t.Fatalf("got a TTL of %v, want the written one kept", ttl)
+	}
+	if watchers != 2 {
+		t.Fatalf("got %d watchers, want 2", watchers)
+	}
+
+	partial := newRoom(t, time.Minute)
+	partial.Add("b")
+	if _, err := partial.ReadFrom(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+	if exists(partial, "a") {
+		t.Fatal("sessions were added despite the error")
+	}
+}
+
+func TestIdenValidator(t *testing.T) {
+	r := newRoom(t, time.Minute, WithIdenValidator(func(iden string) error {
+		if iden == "" || len(iden) > 256 {
+			return ErrInvalidIden
+		}
+		return nil
+	}))
+
+	for _, iden := range []string{"", strings.Repeat("x", 257)} {
+		if err := r.Add(iden); !errors.Is(err, ErrInvalidIden) {
+			t.Errorf("Add: got %v, want ErrInvalidIden", err)
+		}
+		if err := r.AddWith(iden, nil); !errors.Is(err, ErrInvalidIden) {
+			t.Errorf("AddWith: got %v, want ErrInvalidIden", err)
+		}
+	}
+	if err := r.Add(strings.Repeat("x", 256)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActiveWatchers(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+	r.Add("b")
+	r.Add("c")
+	if n := r.ActiveWatchers(); n != 3 {
+		t.Fatalf("got %d, want 3", n)
+	}
+
+	r.Del("a")
+	waitFor(t, func() bool { return r.ActiveWatchers() == 2 })
+
+	setTTL(r, "b", time.Millisecond)
+	waitFor(t, func() bool { return r.ActiveWatchers() == 1 && !exists(r, "b") })
+
+	r.Close()
+	waitFor(t, func() bool { return r.ActiveWatchers() == 0 })
+}
+
+func TestValueCompression(t *testing.T) {
+	r := newRoom(t, time.Minute, WithValueCompression(100))
+	r.Add("a")
+
+	large := strings.Repeat("compress me ", 100)
+	r.Set("a", "large", large)
+	r.Set("a", "small", "tiny")
+
+	if v, _ := r.Get("a", "large"); v != large {
+		t.Fatal("large value didn't round-trip")
+	}
+	if v, _ := r.Get("a", "small"); v != "tiny" {
+		t.Fatalf("got %q, want tiny", v)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if stored := r.sessions["a"]["large"]; len(stored) >= len(large) {
+		t.Fatalf("large value stored in %d bytes, want it compressed", len(stored))
+	}
+	if stored := r.sessions["a"]["small"]; stored != "tiny" {
+		t.Fatalf("small value stored as %q, want it uncompressed", stored)
+	}
+}
+
+func TestTryGet(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"k": "v"})
+
+	if v, ok := r.TryGet("a", "k"); v != "v" || !ok {
+		t.Fatalf("got %q, %v", v, ok)
+	}
+	if _, ok := r.TryGet("a", "missing"); ok {
+		t.Fatal("got a value for a missing key")
+	}
+
+	r.mutex.Lock()
+	_, ok := r.TryGet("a", "k")
+	r.mutex.Unlock()
+	if ok {
+		t.Fatal("got a value while the Room was locked")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	r := newRoom(t, time.Minute, WithKeyHistory(10))
+	r.AddWith("old", map[string]string{"k": "v"})
+	r.Tag("old", "admin")
+	hooked := make(chan struct{})
+	r.SetExpiryHook("old", func() { close(hooked) })
+	setTTL(r, "old", 30*time.Second)
+	r.Add("taken")
+
+	if err := r.Rotate("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	// checked before Get touches the session
+	r.mutex.Lock()
+	ttl := time.Until(r.deadlines["new"])
+	r.mutex.Unlock()
+	if ttl > 30*time.Second || ttl < 29*time.Second {
+		t.Fatalf("got a TTL of %v, want the old one kept", ttl)
+	}
+	if exists(r, "old") {
+		t.Fatal("old iden still exists")
+	}
+	if v, _ := r.Get("new", "k"); v != "v" {
+		t.Fatalf("got %q, want the values moved", v)
+	}
+	if tags, _ := r.Tags("new"); fmt.Sprint(tags) != "[admin]" {
+		t.Fatalf("got tags %v", tags)
+	}
+	if history, _ := r.History("new"); len(history) != 1 || history[0].Key != "k" {
+		t.Fatalf("got history %v, want it kept", history)
+	}
+
+	if err := r.Rotate("new", "taken"); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+	if err := r.Rotate("missing", "other"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+
+	r.Del("new")
+	select {
+	case <-hooked:
+	default:
+		t.Fatal("expiry hook wasn't kept")
+	}
+}
+
+func TestSoftDel(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	e := watchExpiries(r)
+	r.AddWith("a", map[string]string{"k": "v"})
+	r.AddWith("b", nil)
+
+	if err := r.SoftDel("a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get("a", "k"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want a soft deleted session to be hidden", err)
+	}
+	if err := r.Restore("a"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.Get("a", "k"); v != "v" {
+		t.Fatalf("got %q after Restore, want v", v)
+	}
+
+	r.SoftDel("b", 10*time.Millisecond)
+	waitFor(t, func() bool { _, ok := e.reason("b"); return ok })
+	if reason, _ := e.reason("b"); reason != ReasonManual {
+		t.Fatalf("got reason %v, want manual", reason)
+	}
+	if err := r.Restore("b"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v after the grace period, want ErrDoesntExist", err)
+	}
+	if _, ok := e.reason("a"); ok {
+		t.Fatal("restored session was reported as removed")
+	}
+}
+
+func TestAddMany(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("b")
+
+	errs := r.AddMany([]string{"a", "b", "c"})
+	if len(errs) != 1 || !errors.Is(errs["b"], ErrAlreadyExists) {
+		t.Fatalf("got %v, want ErrAlreadyExists for b only", errs)
+	}
+	if !exists(r, "a") || !exists(r, "c") {
+		t.Fatal("sessions weren't added")
+	}
+}
+
+// manyIdens returns n distinct idens.
+func manyIdens(n int) []string {
+	idens := make([]string, n)
+	for i := range idens {
+		idens[i] = strconv.Itoa(i)
+	}
+	return idens
+}
+
+func BenchmarkAddMany(b *testing.B) {
+	idens := manyIdens(1000)
+	for i := 0; i < b.N; i++ {
+		r := NewRoom(time.Minute)
+		r.AddMany(idens)
+		r.Close()
+	}
+}
+
+func BenchmarkAddLoop(b *testing.B) {
+	idens := manyIdens(1000)
+	for i := 0; i < b.N; i++ {
+		r := NewRoom(time.Minute)
+		for _, iden := range idens {
+			r.Add(iden)
+		}
+		r.Close()
+	}
+}
+
+func TestIterator(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddMany(manyIdens(1000))
+
+	var (
+		it   = r.Iterator(64)
+		seen = make(map[string]bool)
+	)
+	for {
+		batch, ok := it.Next()
+		if !ok {
+			break
+		}
+		if len(batch) > 64 {
+			t.Fatalf("got a batch of %d, want at most 64", len(batch))
+		}
+		for _, info := range batch {
+			if seen[info.Iden] {
+				t.Fatalf("%s returned twice", info.Iden)
+			}
+			seen[info.Iden] = true
+		}
+		// removed sessions are skipped
+		r.Del("999")
+	}
+	if len(seen) != 999 {
+		t.Fatalf("saw %d sessions, want 999", len(seen))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	for _, values := range []bool{false, true} {
+		var (
+			buf  = &syncBuffer{}
+			opts = []Option{WithAuditLog(buf)}
+		)
+		if values {
+			opts = append(opts, WithAuditValues())
+		}
+		r := newRoom(t, time.Minute, opts...)
+		r.Add("a")
+		r.Set("a", "k", "secret")
+		r.UpdateKey("a", "k", func(string, bool) (string, bool, error) { return "", true, nil })
+		r.Del("a")
+
+		waitFor(t, func() bool { return len(buf.lines()) == 4 })
+		var ops []string
+		for _, entry := range buf.entries(t) {
+			ops = append(ops, entry.Op+" "+entry.Iden+" "+entry.Key+" "+entry.Reason)
+			if entry.Time.IsZero() {
+				t.Fatal("entry has no time")
+			}
+			if entry.Op == "set" && (entry.Value != nil) != values {
+				t.Fatalf("got value %v with WithAuditValues %v", entry.Value, values)
+			}
+		}
+		want := []string{"add a  ", "set a k ", "delkey a k ", "del a  manual"}
+		if fmt.Sprint(ops) != fmt.Sprint(want) {
+			t.Fatalf("got %q, want %q", ops, want)
+		}
+	}
+}
+
+func TestAuditErr(t *testing.T) {
+	if err := newRoom(t, time.Minute).AuditErr(); err != nil {
+		t.Fatalf("got %v without an audit log", err)
+	}
+
+	errAudit := errors.New("disk full")
+	reader, writer := io.Pipe()
+	reader.CloseWithError(errAudit)
+	r := newRoom(t, time.Minute, WithAuditLog(writer))
+	r.Add("a")
+	waitFor(t, func() bool { return r.AuditErr() != nil })
+
+	r.Add("b")
+	if err := r.AuditErr(); !errors.Is(err, errAudit) {
+		t.Fatalf("got %v, want the write error", err)
+	}
+}
+
+func TestNextExpiry(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	if _, ok := r.NextExpiry(); ok {
+		t.Fatal("got an expiry for an empty Room")
+	}
+
+	r.Add("a")
+	r.Add("b")
+	setTTL(r, "b", 10*time.Second)
+	if ttl, ok := r.NextExpiry(); !ok || ttl > 10*time.Second || ttl < 9*time.Second {
+		t.Fatalf("got %v, %v, want about 10s", ttl, ok)
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	r := newRoom(t, 50*time.Millisecond,
+		WithShardFunc(func(iden string) bool { return !strings.HasPrefix(iden, "other-") }))
+	e := watchExpiries(r)
+	r.AddWith("old", map[string]string{"k": "v"})
+	r.AddWith("kept", map[string]string{"k": "old"})
+	_, release, _ := r.Reserve("reserved")
+	defer release()
+
+	for _, test := range []struct {
+		iden string
+		err  error
+	}{
+		{"reserved", ErrAlreadyExists},
+		{"other-room", ErrNotOwned},
+	} {
+		err := r.ReplaceAll(map[string]map[string]string{"new": {}, test.iden: {}})
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: got %v, want %v", test.iden, err, test.err)
+		}
+		if !exists(r, "old") || exists(r, "new") {
+			t.Fatal("the Room was changed despite the error")
+		}
+	}
+
+	if err := r.ReplaceAll(map[string]map[string]string{
+		"new":  {"k": "v"},
+		"kept": {"k": "new"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(r, "old") {
+		t.Fatal("old session wasn't removed")
+	}
+	for _, iden := range []string{"old", "kept"} {
+		if reason, _ := e.reason(iden); reason != ReasonReplaced {
+			t.Fatalf("%s: got reason %v, want replaced", iden, reason)
+		}
+	}
+	if v, _ := r.Get("kept", "k"); v != "new" {
+		t.Fatalf("got %q, want the new value", v)
+	}
+	waitFor(t, func() bool { return r.ActiveWatchers() == 2 })
+	waitFor(t, r.IsEmpty)
+}
+
+func TestKeyHistory(t *testing.T) {
+	r := newRoom(t, time.Minute, WithKeyHistory(3))
+	r.Add("a")
+	for i := 1; i <= 5; i++ {
+		r.Set("a", "n", strconv.Itoa(i))
+	}
+
+	history, err := r.History("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, change := range history {
+		changes = append(changes, change.Old+">"+change.New)
+	}
+	if want := []string{"2>3", "3>4", "4>5"}; fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", changes, want)
+	}
+
+	r.Del("a")
+	r.Add("a")
+	if history, _ := r.History("a"); len(history) != 0 {
+		t.Fatalf("got %v, want the history cleared with the session", history)
+	}
+}
+
+func TestErrorWrapping(t *testing.T) {
+	r := newRoom(t, time.Minute, WithMaxValueBytes(8))
+	r.AddWith("a", map[string]string{"flag": "maybe"})
+
+	for _, test := range []struct {
+		err      error
+		sentinel error
+		contains []string
+	}{
+		{r.Add("a"), ErrAlreadyExists, []string{`"a"`}},
+		{r.Set("missing", "k", "v"), ErrDoesntExist, []string{`"missing"`}},
+		{func() error { _, err := r.Get("a", "nope"); return err }(), ErrKeyDoesntExist, []string{`"a"`, `"nope"`}},
+		{r.Set("a", "k", "too large"), ErrValueTooLarge, []string{"9 bytes"}},
+		{func() error { _, err := r.Toggle("a", "flag"); return err }(), ErrNotABool, []string{`"flag"`}},
+	} {
+		if !errors.Is(test.err, test.sentinel) {
+			t.Errorf("got %v, want %v", test.err, test.sentinel)
+			continue
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(test.err.Error(), s) {
+				t.Errorf("%q doesn't mention %s", test.err, s)
+			}
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	var calls atomic.Int64
+	r := newRoom(t, time.Minute, WithMigrator(func(iden string, values map[string]string) (map[string]string, bool) {
+		calls.Add(1)
+		name, ok := values["username"]
+		if !ok {
+			return nil, false
+		}
+		delete(values, "username")
+		values["name"] = name
+		return values, true
+	}))
+	r.AddWith("a", map[string]string{"username": "alice"})
+
+	for i := 0; i < 2; i++ {
+		if v, err := r.Get("a", "name"); v != "alice" || err != nil {
+			t.Fatalf("got %q, %v", v, err)
+		}
+		if _, err := r.Get("a", "username"); !errors.Is(err, ErrKeyDoesntExist) {
+			t.Fatalf("got %v, want the old key gone", err)
+		}
+	}
+
+	r.Rotate("a", "b")
+	r.Get("b", "name")
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("migrator called %d times, want 1", n)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	r := newRoom(t, time.Minute, WithReservationTimeout(20*time.Millisecond))
+
+	commit, _, err := r.Reserve("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("a"); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v while reserved, want ErrAlreadyExists", err)
+	}
+	if err := commit(); err != nil || !exists(r, "a") {
+		t.Fatalf("got %v, want the session committed", err)
+	}
+
+	commit, release, _ := r.Reserve("b")
+	release()
+	if err := commit(); !errors.Is(err, ErrNotReserved) {
+		t.Fatalf("got %v after release, want ErrNotReserved", err)
+	}
+	if err := r.Add("b"); err != nil {
+		t.Fatalf("got %v after release, want nil", err)
+	}
+
+	commit, _, _ = r.Reserve("c")
+	waitFor(t, func() bool { return r.Add("c") == nil })
+	if err := commit(); !errors.Is(err, ErrNotReserved) {
+		t.Fatalf("got %v after the timeout, want ErrNotReserved", err)
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	r := newRoom(t, 20*time.Millisecond)
+	if !r.IsEmpty() {
+		t.Fatal("new Room isn't empty")
+	}
+
+	r.Add("a")
+	if r.IsEmpty() {
+		t.Fatal("Room with a session is empty")
+	}
+	waitFor(t, r.IsEmpty)
+}
+
+func TestAddEncrypted(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	key := bytes.Repeat([]byte{7}, 32)
+
+	if err := r.AddEncrypted("a", key[:5]); err == nil {
+		t.Fatal("got no error for a bad key")
+	}
+	if err := r.AddEncrypted("a", key); err != nil {
+		t.Fatal(err)
+	}
+	r.Set("a", "secret", "plaintext")
+
+	if v, _ := r.Get("a", "secret"); v != "plaintext" {
+		t.Fatalf("got %q, want plaintext", v)
+	}
+	var buf bytes.Buffer
+	r.ExportCSV(&buf, []string{"secret"})
+	if !strings.Contains(buf.String(), "plaintext") {
+		t.Fatalf("got %q, want ExportCSV to see plaintext", buf.String())
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if stored := r.sessions["a"]["secret"]; strings.Contains(stored, "plaintext") {
+		t.Fatal("value is stored as plaintext")
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	warnings := make(chan string, 10)
+	r := newRoom(t, 100*time.Millisecond, WithExpiryWarning(50*time.Millisecond, func(iden string) {
+		warnings <- iden
+	}))
+	r.AddWith("a", map[string]string{"k": "v"})
+	r.AddWith("busy", map[string]string{"k": "v"})
+
+	// sessions touched well within the threshold are never warned about
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				r.Get("busy", "k")
+			}
+		}
+	}()
+
+	select {
+	case iden := <-warnings:
+		if iden != "a" {
+			t.Fatalf("got a warning for %s, want a", iden)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no warning")
+	}
+
+	// touching re-arms the warning for the new deadline
+	r.Get("a", "k")
+	start := time.Now()
+	select {
+	case iden := <-warnings:
+		if iden != "a" {
+			t.Fatalf("got a warning for %s, want a", iden)
+		}
+		if time.Since(start) < 40*time.Millisecond {
+			t.Fatal("warned before the session neared its new deadline")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("touching didn't re-arm the warning")
+	}
+	if !exists(r, "a") {
+		t.Fatal("warned after the session expired")
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	for i := 0; i < 100; i++ {
+		iden, _ := r.AddAuto()
+		r.Del(iden)
+	}
+	r.mutex.Lock()
+	if n := len(r.removed); n != 0 {
+		t.Fatalf("remembered %d removals before Checkpoint, want 0", n)
+	}
+	r.mutex.Unlock()
+
+	r.Add("a")
+	r.Add("b")
+	r.Add("c")
+
+	token := r.Checkpoint()
+	r.Set("a", "k", "v")
+	r.Del("b")
+	r.Add("d")
+	r.Get("c", "k")
+
+	changed, removed := r.ChangedSince(token)
+	if len(changed) != 2 || changed["a"]["k"] != "v" || changed["d"] == nil {
+		t.Fatalf("got %v, want a and d", changed)
+	}
+	if fmt.Sprint(removed) != "[b]" {
+		t.Fatalf("got %v, want [b]", removed)
+	}
+
+	next := r.Checkpoint()
+	if changed, removed := r.ChangedSince(next); len(changed) != 0 || len(removed) != 0 {
+		t.Fatalf("got %v, %v, want nothing", changed, removed)
+	}
+
+	r.Forget(next)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if n := len(r.removed); n != 0 {
+		t.Fatalf("remembered %d removals after Forget, want 0", n)
+	}
+}
+
+func TestExpiryWorkers(t *testing.T) {
+	r := newRoom(t, 20*time.Millisecond, WithExpiryWorkers(2))
+	var (
+		release = make(chan struct{})
+		removed = make(chan string, 10)
+	)
+	r.OnExpire(func(iden string, reason Reason) {
+		if iden == "slow" {
+			<-release
+		}
+		removed <- iden
+	})
+	r.AddMany([]string{"slow", "a", "b", "c"})
+	setTTL(r, "slow", time.Millisecond)
+
+	// a slow callback doesn't hold up the removal of other sessions
+	for i := 0; i < 3; i++ {
+		select {
+		case iden := <-removed:
+			if iden == "slow" {
+				t.Fatal("slow callback returned before being released")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("callbacks stalled behind a slow one")
+		}
+	}
+	if !r.IsEmpty() {
+		t.Fatal("sessions weren't removed")
+	}
+
+	close(release)
+	if iden := <-removed; iden != "slow" {
+		t.Fatalf("got %s, want slow", iden)
+	}
+}
+
+func TestPeekKeyAll(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"k": "1"})
+	r.AddWith("b", map[string]string{"k": "2"})
+	r.AddWith("c", nil)
+
+	r.mutex.Lock()
+	deadline := r.deadlines["a"]
+	r.mutex.Unlock()
+
+	if got := r.PeekKeyAll("k"); fmt.Sprint(got) != "map[a:1 b:2]" {
+		t.Fatalf("got %v", got)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.deadlines["a"].Equal(deadline) {
+		t.Fatal("PeekKeyAll touched the session")
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	r := newRoom(t, time.Minute, WithTombstone("<deleted>"))
+	r.AddWith("a", map[string]string{"k": "v", "other": "<deleted>"})
+
+	if err := r.Set("a", "k", "<deleted>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get("a", "k"); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v, want the key deleted", err)
+	}
+	if err := r.Set("a", "missing", "<deleted>"); err != nil {
+		t.Fatalf("got %v deleting a missing key, want nil", err)
+	}
+	if v, _ := r.Get("a", "other"); v != "<deleted>" {
+		t.Fatalf("got %q, want AddWith to store the tombstone", v)
+	}
+}
+
+func TestWaitUntilBelow(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddMany([]string{"a", "b", "c"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.WaitUntilBelow(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- r.WaitUntilBelow(context.Background(), 2) }()
+
+	r.Del("a")
+	select {
+	case <-done:
+		t.Fatal("returned with 2 sessions left")
+	case <-time.After(10 * time.Millisecond):
+	}
+	r.Del("b")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.WaitUntilBelow(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementBounded(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"text": "x"})
+
+	for _, test := range []struct {
+		delta, min, max int64
+		wrap            bool
+		want            int64
+	}{
+		{2, 0, 3, false, 2},
+		{5, 0, 3, false, 3},
+		{-10, 0, 3, false, 0},
+		{3, 0, 3, true, 3},
+		{1, 0, 3, true, 0},
+		{-1, 0, 3, true, 3},
+	} {
+		got, err := r.IncrementBounded("a", "n", test.delta, test.min, test.max, test.wrap)
+		if err != nil || got != test.want {
+			t.Fatalf("%+v: got %d, %v", test, got, err)
+		}
+	}
+
+	if _, err := r.IncrementBounded("a", "n", 1, 3, 0, false); !errors.Is(err, ErrInvalidBounds) {
+		t.Fatalf("got %v, want ErrInvalidBounds", err)
+	}
+	if _, err := r.IncrementBounded("a", "text", 1, 0, 3, false); !errors.Is(err, ErrNotAnInt) {
+		t.Fatalf("got %v, want ErrNotAnInt", err)
+	}
+}
+
+func TestBytesValues(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	value := []byte{0, 1, 0, 255, 0}
+	if err := r.SetBytes("a", "bin", value); err != nil {
+		t.Fatal(err)
+	}
+	value[1] = 2
+
+	got, err := r.GetBytes("a", "bin")
+	if err != nil || !bytes.Equal(got, []byte{0, 1, 0, 255, 0}) {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	got[0] = 9
+	if v, _ := r.Get("a", "bin"); v != "\x00\x01\x00\xff\x00" {
+		t.Fatalf("got %q, want the stored bytes unchanged", v)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	const n = 20000
+	r := newRoom(t, time.Minute)
+	r.AddMany(manyIdens(n))
+	for i := 10; i < n; i++ {
+		r.Del(strconv.Itoa(i))
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	r.Compact()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	if after.HeapAlloc >= before.HeapAlloc {
+		t.Fatalf("heap grew from %d to %d bytes", before.HeapAlloc, after.HeapAlloc)
+	}
+	for i := 0; i < 10; i++ {
+		if !exists(r, strconv.Itoa(i)) {
+			t.Fatalf("session %d didn't survive", i)
+		}
+	}
+	setTTL(r, "0", time.Millisecond)
+	waitFor(t, func() bool { return !exists(r, "0") })
+}
+
+func TestKeyModified(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+	r.Set("a", "k", "v")
+
+	written, err := r.KeyModified("a", "k")
+	if err != nil || time.Since(written) > time.Second {
+		t.Fatalf("got %v, %v", written, err)
+	}
+	time.Sleep(time.Millisecond)
+	r.Get("a", "k")
+	if again, _ := r.KeyModified("a", "k"); !again.Equal(written) {
+		t.Fatal("reading the key changed its modification time")
+	}
+	r.Set("a", "k", "w")
+	if again, _ := r.KeyModified("a", "k"); !again.After(written) {
+		t.Fatal("writing the key didn't change its modification time")
+	}
+	if _, err := r.KeyModified("a", "missing"); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v, want ErrKeyDoesntExist", err)
+	}
+}
+
+func TestView(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"b": "2", "a": "1"})
+
+	view, err := r.View("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Set("a", "a", "changed")
+	r.Set("a", "c", "3")
+
+	if v, ok := view.Get("a"); v != "1" || !ok {
+		t.Fatalf("got %q, %v, want the view unchanged", v, ok)
+	}
+	if keys := view.Keys(); fmt.Sprint(keys) != "[a b]" || view.Len() != 2 {
+		t.Fatalf("got keys %v", keys)
+	}
+	if _, err := r.View("missing"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	for i, want := range []bool{true, true, false} {
+		if took, err := r.TakeToken("a", "tokens", "ts", 1, 2); took != want || err != nil {
+			t.Fatalf("take %d: got %v, %v, want %v", i, took, err, want)
+		}
+	}
+
+	// a second passing refills a token
+	past := time.Now().Add(-time.Second).UnixNano()
+	r.Set("a", "ts", strconv.FormatInt(past, 10))
+	if took, _ := r.TakeToken("a", "tokens", "ts", 1, 2); !took {
+		t.Fatal("bucket wasn't refilled")
+	}
+
+	r.Set("a", "tokens", "many")
+	if _, err := r.TakeToken("a", "tokens", "ts", 1, 2); !errors.Is(err, ErrNotANumber) {
+		t.Fatalf("got %v, want ErrNotANumber", err)
+	}
+}
+
+func TestCreationStacks(t *testing.T) {
+	r := newRoom(t, time.Minute, WithCreationStacks())
+	r.Add("a")
+
+	stack, err := r.CreationStack("a")
+	if err != nil || !strings.Contains(stack, "TestCreationStacks") {
+		t.Fatalf("got %q, %v", stack, err)
+	}
+
+	plain := newRoom(t, time.Minute)
+	plain.Add("a")
+	if stack, _ := plain.CreationStack("a"); stack != "" {
+		t.Fatal("got a stack without WithCreationStacks")
+	}
+}
+
+func TestShardFunc(t *testing.T) {
+	r := newRoom(t, time.Minute, WithShardFunc(func(iden string) bool {
+		return strings.HasPrefix(iden, "mine-")
+	}))
+
+	if !r.OwnsIden("mine-a") || r.OwnsIden("other-a") {
+		t.Fatal("OwnsIden disagrees with the shard func")
+	}
+	if err := r.Add("mine-a"); err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"Add":     r.Add("other-a"),
+		"AddWith": r.AddWith("other-b", nil),
+		"Rotate":  r.Rotate("mine-a", "other-c"),
+	} {
+		if !errors.Is(err, ErrNotOwned) {
+			t.Errorf("%s: got %v, want ErrNotOwned", name, err)
+		}
+	}
+}
+
+func TestCompareAndDel(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"marker": "1"})
+
+	if deleted, err := r.CompareAndDel("a", "marker", "2"); deleted || err != nil {
+		t.Fatalf("got %v, %v, want the session kept", deleted, err)
+	}
+	if deleted, err := r.CompareAndDel("a", "missing", ""); deleted || err != nil {
+		t.Fatalf("got %v, %v for a missing key", deleted, err)
+	}
+	if deleted, err := r.CompareAndDel("a", "marker", "1"); !deleted || err != nil {
+		t.Fatalf("got %v, %v, want the session deleted", deleted, err)
+	}
+	if _, err := r.CompareAndDel("a", "marker", "1"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestMinResetInterval(t *testing.T) {
+	r := newRoom(t, 50*time.Millisecond, WithMinResetInterval(time.Hour))
+	r.AddWith("a", map[string]string{"k": "v"})
+
+	start := time.Now()
+	for exists(r, "a") {
+		if time.Since(start) > time.Second {
+			t.Fatal("activity kept the session alive")
+		}
+		r.Get("a", "k")
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCreatedSince(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("old")
+	r.Add("new")
+
+	r.mutex.Lock()
+	r.createdAt["old"] = time.Now().Add(-time.Hour)
+	r.mutex.Unlock()
+
+	if idens := r.CreatedSince(time.Minute); fmt.Sprint(idens) != "[new]" {
+		t.Fatalf("got %v, want [new]", idens)
+	}
+	if idens := r.CreatedSince(time.Nanosecond); idens == nil || len(idens) != 0 {
+		t.Fatalf("got %#v, want an empty slice", idens)
+	}
+}
+
+func TestFlushExpiry(t *testing.T) {
+	r := newRoom(t, 10*time.Millisecond)
+	var done atomic.Int64
+	r.OnExpire(func(string, Reason) {
+		time.Sleep(20 * time.Millisecond)
+		done.Add(1)
+	})
+	r.AddMany([]string{"a", "b"})
+
+	time.Sleep(20 * time.Millisecond)
+	r.FlushExpiry()
+	if n := done.Load(); n != 2 {
+		t.Fatalf("%d callbacks completed, want 2", n)
+	}
+}
+
+func TestGetMatrix(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"x": "1", "y": "2"})
+	r.AddWith("b", map[string]string{"x": "3"})
+
+	r.mutex.Lock()
+	deadline := r.deadlines["a"]
+	r.mutex.Unlock()
+
+	got, err := r.GetMatrix([]string{"a", "b", "missing"}, []string{"x", "y"})
+	if err != nil || fmt.Sprint(got) != "map[a:map[x:1 y:2] b:map[x:3]]" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.deadlines["a"].Equal(deadline) {
+		t.Fatal("GetMatrix touched the session")
+	}
+}
+
+func TestDuplicateValues(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"c": "x", "a": "x", "b": "y", "d": "z", "e": "y"})
+
+	got, err := r.DuplicateValues("a")
+	if err != nil || fmt.Sprint(got) != "map[x:[a c] y:[b e]]" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+}
+
+func TestFactory(t *testing.T) {
+	errFactory := errors.New("database down")
+	r := newRoom(t, time.Minute, WithFactory(func(iden string) (map[string]string, error) {
+		if iden == "broken" {
+			return nil, errFactory
+		}
+		return map[string]string{"user": iden}, nil
+	}))
+
+	if err := r.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.Get("a", "user"); v != "a" {
+		t.Fatalf("got %q, want the factory's value", v)
+	}
+	if err := r.Add("broken"); !errors.Is(err, errFactory) {
+		t.Fatalf("got %v, want the factory's error", err)
+	}
+	if exists(r, "broken") {
+		t.Fatal("session was created despite the error")
+	}
+}
+
+func TestWaitForValue(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddMany([]string{"a", "b"})
+
+	found := make(chan string)
+	go func() {
+		iden, err := r.WaitForValue(context.Background(), "status", "ready")
+		if err != nil {
+			t.Error(err)
+		}
+		found <- iden
+	}()
+
+	r.Set("a", "status", "pending")
+	r.Set("b", "status", "ready")
+	if iden := <-found; iden != "b" {
+		t.Fatalf("got %s, want b", iden)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.WaitForValue(ctx, "status", "done"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestIdleOrMaxAgePolicy(t *testing.T) {
+	r := newRoom(t, time.Minute, WithExpiryPolicy(func(info SessionInfo) time.Time {
+		idle := info.LastAccess.Add(30 * time.Millisecond)
+		if maxAge := info.CreatedAt.Add(100 * time.Millisecond); maxAge.Before(idle) {
+			return maxAge
+		}
+		return idle
+	}))
+	r.AddWith("busy", map[string]string{"k": "v"})
+	r.Add("idle")
+	start := time.Now()
+
+	busy := make(chan time.Duration)
+	go func() {
+		for exists(r, "busy") {
+			r.Get("busy", "k")
+			time.Sleep(5 * time.Millisecond)
+		}
+		busy <- time.Since(start)
+	}()
+
+	waitFor(t, func() bool { return !exists(r, "idle") })
+	if time.Since(start) > 90*time.Millisecond {
+		t.Fatal("idle session outlived its idle timeout")
+	}
+	if age := <-busy; age < 90*time.Millisecond || age > time.Second {
+		t.Fatalf("busy session lived for %v, want its maximum age", age)
+	}
+}
+
+func TestCount(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"role": "admin"})
+	r.AddWith("b", map[string]string{"role": "user"})
+	r.AddWith("c", map[string]string{"role": "admin"})
+
+	n := r.Count(func(iden string, values map[string]string) bool {
+		return values["role"] == "admin"
+	})
+	if n != 2 {
+		t.Fatalf("got %d, want 2", n)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	allowed := map[string]struct{}{"user": {}}
+
+	strict := newRoom(t, time.Minute, WithSchema(allowed, true))
+	strict.Add("a")
+	if err := strict.Set("a", "user", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.Set("a", "other", "1"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v, want ErrUnknownKey", err)
+	}
+	if err := strict.AddWith("b", map[string]string{"other": "1"}); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v, want ErrUnknownKey", err)
+	}
+	if n, _ := strict.KeyCount("a"); n != 1 {
+		t.Fatalf("got %d keys, want the session unchanged", n)
+	}
+
+	var unknown []string
+	loose := newRoom(t, time.Minute, WithSchema(allowed, false), WithUnknownKeyHook(func(iden, key string) {
+		unknown = append(unknown, iden+"."+key)
+	}))
+	loose.Add("a")
+	loose.Set("a", "user", "1")
+	if err := loose.Set("a", "other", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(unknown) != "[a.other]" {
+		t.Fatalf("got %v, want the hook called once", unknown)
+	}
+}
+
+func TestSetAndNotify(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.Add("a")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.GetWait(context.Background(), "a", "k")
+	}()
+	go func() {
+		defer wg.Done()
+		r.WaitForValue(context.Background(), "k", "v")
+	}()
+	waitFor(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return r.keyWaiters[[2]string{"a", "k"}] == 1 && r.valWaiters[[2]string{"k", "v"}] == 1
+	})
+
+	if n, err := r.SetAndNotify("a", "k", "v"); n != 2 || err != nil {
+		t.Fatalf("got %d, %v, want 2", n, err)
+	}
+	wg.Wait()
+	if n, _ := r.SetAndNotify("a", "k", "v"); n != 0 {
+		t.Fatalf("got %d with no waiters, want 0", n)
+	}
+}
+
+func TestExpiryTombstones(t *testing.T) {
+	r := newRoom(t, 10*time.Millisecond, WithExpiryTombstones(time.Minute))
+	r.Add("a")
+	r.Add("b")
+	r.Del("b")
+
+	waitFor(t, func() bool { return !exists(r, "a") })
+	if at, ok := r.RecentlyExpired("a"); !ok || time.Since(at) > time.Second {
+		t.Fatalf("got %v, %v", at, ok)
+	}
+	if _, ok := r.RecentlyExpired("b"); ok {
+		t.Fatal("deleted session was remembered as expired")
+	}
+
+	r.Add("a")
+	if _, ok := r.RecentlyExpired("a"); ok {
+		t.Fatal("re-added session was still remembered as expired")
+	}
+}
+
+func TestGetAllMulti(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"k": "1"})
+	r.AddWith("b", map[string]string{"k": "2"})
+
+	got, err := r.GetAllMulti("a", "b")
+	if err != nil || fmt.Sprint(got) != "map[a:map[k:1] b:map[k:2]]" {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	if _, err := r.GetAllMulti("a", "missing"); !errors.Is(err, ErrDoesntExist) {
+		t.Fatalf("got %v, want ErrDoesntExist", err)
+	}
+}
+
+func TestDeleteGuard(t *testing.T) {
+	var (
+		keep  atomic.Bool
+		calls atomic.Int64
+	)
+	keep.Store(true)
+	r := newRoom(t, 10*time.Millisecond, WithDeleteGuard(func(iden string, reason Reason) bool {
+		calls.Add(1)
+		return !keep.Load()
+	}))
+	e := watchExpiries(r)
+	r.Add("a")
+
+	if err := r.Del("a"); !errors.Is(err, ErrVetoed) {
+		t.Fatalf("got %v, want ErrVetoed", err)
+	}
+
+	// a kept session gets another lifetime, and expires again after it
+	waitFor(t, func() bool { return calls.Load() >= 4 })
+	if !exists(r, "a") {
+		t.Fatal("guarded session expired")
+	}
+
+	keep.Store(false)
+	waitFor(t, func() bool { return !exists(r, "a") })
+	if reason, _ := e.reason("a"); reason != ReasonIdle {
+		t.Fatalf("got reason %v, want idle", reason)
+	}
+}
+
+func TestDiffFrom(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("kept", map[string]string{"same": "1", "changed": "1", "removed": "1"})
+	r.AddWith("gone", nil)
+	r.AddWith("untouched", map[string]string{"k": "v"})
+	snapshot := r.Snapshot()
+
+	r.Del("gone")
+	r.Add("new")
+	r.Set("kept", "changed", "2")
+	r.Set("kept", "added", "1")
+	r.UpdateKey("kept", "removed", func(string, bool) (string, bool, error) { return "", true, nil })
+
+	added, removed, changed := r.DiffFrom(snapshot)
+	if fmt.Sprint(added) != "[new]" || fmt.Sprint(removed) != "[gone]" {
+		t.Fatalf("got added %v, removed %v", added, removed)
+	}
+	if fmt.Sprint(changed) != "map[kept:[added changed removed]]" {
+		t.Fatalf("got changed %v", changed)
+	}
+}
+
+func TestAddPriority(t *testing.T) {
+	r := newRoom(t, time.Minute, WithCreateRateLimit(1, time.Minute))
+
+	if err := r.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("b"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	if err := r.AddPriority("b"); err != nil {
+		t.Fatalf("got %v, want AddPriority to skip the limit", err)
+	}
+	if err := r.AddPriority("b"); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v, want ErrAlreadyExists", err)
+	}
+
+	seeded := newRoom(t, time.Minute, WithFactory(func(iden string) (map[string]string, error) {
+		return map[string]string{"user": iden}, nil
+	}))
+	seeded.AddPriority("a")
+	if v, _ := seeded.Get("a", "user"); v != "a" {
+		t.Fatalf("got %q, want the factory's value", v)
+	}
+}
+
+func TestAgeHistogram(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddMany([]string{"new", "minutes", "hours"})
+
+	r.mutex.Lock()
+	r.createdAt["minutes"] = time.Now().Add(-5 * time.Minute)
+	r.createdAt["hours"] = time.Now().Add(-5 * time.Hour)
+	r.mutex.Unlock()
+
+	got := r.AgeHistogram([]time.Duration{time.Minute, time.Hour})
+	if fmt.Sprint(got) != "[1 1 1]" {
+		t.Fatalf("got %v, want [1 1 1]", got)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"k": "v"})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, err := range map[string]error{
+		"Close":   r.Close(),
+		"Add":     r.Add("b"),
+		"AddWith": r.AddWith("b", nil),
+		"Set":     r.Set("a", "k", "v"),
+		"Del":     r.Del("a"),
+		"Get":     func() error { _, err := r.Get("a", "k"); return err }(),
+		"GetFull": func() error { _, _, _, err := r.GetFull("a", "k"); return err }(),
+		"View":    func() error { _, err := r.View("a"); return err }(),
+		"Restore": r.Restore("a"),
+		"Group":   r.Group("g"),
+		"AddAuto": func() error { _, err := r.AddAuto(); return err }(),
+		"GetWait": func() error { _, err := r.GetWait(context.Background(), "a", "x"); return err }(),
+		"WaitForValue": func() error {
+			_, err := r.WaitForValue(context.Background(), "k", "x")
+			return err
+		}(),
+		"GetMatrix": func() error {
+			_, err := r.GetMatrix([]string{"a"}, []string{"k"})
+			return err
+		}(),
+		"ReadFrom": func() error {
+			var empty bytes.Buffer
+			newRoom(t, time.Minute).WriteTo(&empty)
+			_, err := r.ReadFrom(&empty)
+			return err
+		}(),
+	} {
+		if !errors.Is(err, ErrRoomClosed) {
+			t.Errorf("%s: got %v, want ErrRoomClosed", name, err)
+		}
+	}
+
+	created, _ := r.WaitCreate("b")
+	select {
+	case <-created:
+	default:
+		t.Fatal("WaitCreate returned an open channel")
+	}
+}
+
+func TestCloseRace(t *testing.T) {
+	r := NewRoom(time.Minute)
+	r.Add("a")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := r.Set("a", "k", "v"); errors.Is(err, ErrRoomClosed) {
+					return
+				}
+			}
+		}()
+	}
+	r.Close()
+	wg.Wait()
+}
+
+func TestCloseContext(t *testing.T) {
+	var (
+		r       = NewRoom(time.Minute)
+		release = make(chan struct{})
+		removed = make(chan struct{})
+	)
+	r.OnExpire(func(string, Reason) {
+		close(removed)
+		<-release
+	})
+	r.Add("a")
+	go r.Del("a")
+	<-removed
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	close(release)
+
+	r = NewRoom(time.Minute)
+	r.OnExpire(func(string, Reason) { time.Sleep(10 * time.Millisecond) })
+	r.Add("a")
+	go r.Del("a")
+	waitFor(t, func() bool { return !exists(r, "a") })
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.CloseContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.ActiveWatchers(); n != 0 {
+		t.Fatalf("got %d watchers after shutting down, want 0", n)
+	}
+	if err := r.CloseContext(ctx); !errors.Is(err, ErrRoomClosed) {
+		t.Fatalf("got %v, want ErrRoomClosed", err)
+	}
+}
+
+func TestCloseContextLocked(t *testing.T) {
+	var (
+		r        = NewRoom(time.Minute)
+		release  = make(chan struct{})
+		updating = make(chan struct{})
+	)
+	r.Add("a")
+	go r.UpdateKey("a", "k", func(string, bool) (string, bool, error) {
+		close(updating)
+		<-release
+		return "v", false, nil
+	})
+	<-updating
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	closed := make(chan error)
+	go func() { closed <- r.CloseContext(ctx) }()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want DeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseContext waited on the lock past its ctx")
+	}
+
+	// the Room is closed once the lock is free
+	close(release)
+	waitFor(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return r.closed
+	})
+}
+
+func TestExportEnv(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{
+		"B":     "2",
+		"A":     "x=y\nz",
+		"":      "empty",
+		"C=D":   "bad",
+		"E":     "nul\x00",
+		"F\x00": "nul",
+	})
+
+	env, err := r.ExportEnv("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A=x=y\nz", "B=2"}; fmt.Sprint(env) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", env, want)
+	}
+}
+
+func TestStreamChanges(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	var (
+		buf         = &syncBuffer{}
+		ctx, cancel = context.WithCancel(context.Background())
+		done        = make(chan error)
+	)
+	go func() { done <- r.StreamChanges(ctx, buf) }()
+	waitFor(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return len(r.streams) == 1
+	})
+
+	r.Add("a")
+	r.Set("a", "k", "v")
+	waitFor(t, func() bool { return len(buf.lines()) == 2 })
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want Canceled", err)
+	}
+
+	entries := buf.entries(t)
+	if entries[0].Op != "add" || entries[1].Op != "set" || entries[1].Key != "k" || entries[1].Value != nil {
+		t.Fatalf("got %+v", entries)
+	}
+
+	go func() { done <- r.StreamChanges(context.Background(), &syncBuffer{}) }()
+	waitFor(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return len(r.streams) == 1
+	})
+	r.Close()
+	if err := <-done; !errors.Is(err, ErrRoomClosed) {
+		t.Fatalf("got %v, want ErrRoomClosed", err)
+	}
+}
+
+func TestRenameKey(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	r.AddWith("a", map[string]string{"old": "v", "taken": "w"})
+
+	if err := r.RenameKey("a", "old", "taken"); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("got %v, want ErrKeyExists", err)
+	}
+	if err := r.RenameKey("a", "missing", "new"); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v, want ErrKeyDoesntExist", err)
+	}
+	if err := r.RenameKey("a", "old", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RenameKey("a", "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := r.Get("a", "new"); v != "v" {
+		t.Fatalf("got %q, want v", v)
+	}
+	if _, err := r.Get("a", "old"); !errors.Is(err, ErrKeyDoesntExist) {
+		t.Fatalf("got %v, want the old key gone", err)
+	}
+}
+
+func TestTTLGranularity(t *testing.T) {
+	r := newRoom(t, 250*time.Millisecond, WithTTLGranularity(time.Second))
+	r.Add("a")
+
+	if ttl, _ := r.NextExpiry(); ttl != 0 {
+		t.Fatalf("got %v, want the TTL rounded to 0", ttl)
+	}
+	if infos := r.SessionsByTTL(); infos[0].TTL != 0 {
+		t.Fatalf("got %v, want the TTL rounded to 0", infos[0].TTL)
+	}
+
+	// sessions still expire precisely on time
+	time.Sleep(50 * time.Millisecond)
+	if !exists(r, "a") {
+		t.Fatal("session expired early")
+	}
+	waitFor(t, func() bool { return !exists(r, "a") })
+}
+
+func TestIncrementWithLimit(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	e := watchExpiries(r)
+	r.Add("a")
+
+	for i := int64(1); i < 3; i++ {
+		if n, ended, err := r.IncrementWithLimit("a", "failures", 1, 3); n != i || ended || err != nil {
+			t.Fatalf("got %d, %v, %v", n, ended, err)
+		}
+	}
+	if n, ended, err := r.IncrementWithLimit("a", "failures", 1, 3); n != 3 || !ended || err != nil {
+		t.Fatalf("got %d, %v, %v, want the session ended", n, ended, err)
+	}
+	if reason, _ := e.reason("a"); reason != ReasonLimit || exists(r, "a") {
+		t.Fatalf("got reason %v, want limit", reason)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	r := newRoom(t, time.Minute)
+	var (
+		mutex sync.Mutex
+		calls []string
+	)
+	record := func(name string) func(string, Reason) {
+		return func(iden string, reason Reason) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			calls = append(calls, name+" "+iden)
+		}
+	}
+	r.OnExpire(record("first"))
+	remove := r.OnExpire(record("second"))
+	r.OnExpire(record("third"))
+
+	r.Add("a")
+	r.Del("a")
+	remove()
+	r.Add("b")
+	r.Del("b")
+
+	want := []string{"first a", "second a", "third a", "first b", "third b"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", calls, want)
+	}
+}
+
+func TestClone(t *testing.T) {
+	r := newRoom(t, 50*time.Millisecond)
+	r.AddWith("a", map[string]string{"k": "v"})
+
+	clone := r.Clone()
+	t.Cleanup(func() { clone.Close() })
+
+	clone.Set("a", "k", "changed")
+	clone.Add("b")
+	if v, _ := r.Get("a", "k"); v != "v" {
+		t.Fatalf("got %q, want the original unchanged", v)
+	}
+	if exists(r, "b") {
+		t.Fatal("session added to the clone appeared in the original")
+	}
+
+	r.Close()
+	if v, _ := clone.Get("a", "k"); v != "changed" {
+		t.Fatal("closing the original affected the clone")
+	}
+	waitFor(t, clone.IsEmpty)
+}
+
+func TestExpiryPoolStopped(t *testing.T) {
+	pool := newExpiryPool(1)
+	pool.stop()
+
+	called := false
+	pool.add(func() { called = true })
+	if !called {
+		t.Fatal("callback added after stop was lost")
+	}
+}
+
+func TestCloseWaiters(t *testing.T) {
+	r := NewRoom(time.Minute)
+	r.Add("a")
+
+	created, _ := r.WaitCreate("b")
+	below := make(chan error)
+	go func() { below <- r.WaitUntilBelow(context.Background(), 1) }()
+	waitFor(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return r.removals != nil
+	})
+
+	r.Close()
+	select {
+	case <-created:
+	case <-time.After(time.Second):
+		t.Fatal("WaitCreate wasn't woken")
+	}
+	select {
+	case <-below:
+	case <-time.After(time.Second):
+		t.Fatal("WaitUntilBelow wasn't woken")
+	}
+}
+
+func TestStuckKills(t *testing.T) {
+	r := newRoom(t, 10*time.Millisecond)
+	r.mutex.Lock()
+	r.stuckAfter = 20 * time.Millisecond
+	r.mutex.Unlock()
+
+	// the Reaper is wedged by the callback of the first session it removes
+	release := make(chan struct{})
+	var once sync.Once
+	r.OnExpire(func(string, Reason) { once.Do(func() { <-release }) })
+	r.Add("a")
+	time.Sleep(5 * time.Millisecond)
+	r.Add("b")
+
+	waitFor(t, func() bool { return r.StuckKills() == 1 })
+	close(release)
+	waitFor(t, func() bool { return r.StuckKills() == 0 && r.IsEmpty() })
+}
+
+func TestQueuedKillTouched(t *testing.T) {
+	r := newRoom(t, 50*time.Millisecond)
+	e := watchExpiries(r)
+	r.mutex.Lock()
+	r.stuckAfter = 5 * time.Millisecond
+	r.mutex.Unlock()
+
+	// the Reaper is wedged by the callback of the first session it removes,
+	// so the kill of the second one waits on it
+	release := make(chan struct{})
+	var once sync.Once
+	r.OnExpire(func(string, Reason) { once.Do(func() { <-release }) })
+	r.Add("a")
+	time.Sleep(5 * time.Millisecond)
+	r.Add("b")
+	r.mutex.Lock()
+	watcher := r.watchers["b"]
+	r.mutex.Unlock()
+	waitFor(t, func() bool { return r.StuckKills() == 1 })
+
+	r.Set("b", "k", "v")
+	close(release)
+	waitFor(t, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return r.watchers["b"] != watcher
+	})
+	if !exists(r, "b") {
+		t.Fatal("session was removed by a kill from before it was used")
+	}
+
+	// it still expires once it's left idle
+	waitFor(t, func() bool { _, ok := e.reason("b"); return ok })
+	if reason, _ := e.reason("b"); reason != ReasonIdle {
+		t.Fatalf("got reason %v, want idle", reason)
+	}
+}
@@ -0,0 +1,342 @@
+package gosh
+
+import (
+	"io"
+	"math/rand"
+	"time"
+)
+
+// Loader fetches the value of a key that's missing from a session. It returns
+// false if the value wasn't found.
+type Loader func(iden, key string) (string, bool, error)
+
+// Migrator upgrades the key-value pairs of a session to a new format. It's
+// given a copy of the session's values and returns the upgraded values, along
+// with whether anything was changed.
+type Migrator func(iden string, values map[string]string) (map[string]string, bool)
+
+// Factory returns the key-value pairs a new session identified by the iden
+// param is created with, or an error if it shouldn't be created.
+type Factory func(iden string) (map[string]string, error)
+
+// ExpiryPolicy returns when the session described by the info param should
+// expire. The info's TTL is how long the session had left before the policy
+// was consulted, or zero for a session that's being created.
+type ExpiryPolicy func(info SessionInfo) time.Time
+
+// Option configures a Room when it's created by NewRoom.
+type Option func(*Room)
+
+// WithMaxValueBytes limits values to n bytes. Attempts to set a longer value
+// return ErrValueTooLarge and leave the session unchanged. Zero means values
+// can be any size.
+func WithMaxValueBytes(n int) Option {
+	return func(r *Room) {
+		r.maxValueBytes = n
+	}
+}
+
+// WithLoader makes Get call fn when a key doesn't exist inside of an existing
+// session. If fn finds the value, it's stored in the session and returned. If
+// it doesn't, Get returns ErrKeyDoesntExist. Errors from fn are returned by
+// Get as-is.
+func WithLoader(fn Loader) Option {
+	return func(r *Room) {
+		r.loader = fn
+	}
+}
+
+// WithIdenSource makes AddAuto use fn to generate idens instead of crypto/rand.
+// It's meant for tests that need predictable idens; fn should be unguessable
+// in production, as idens are usually handed to clients.
+func WithIdenSource(fn func() string) Option {
+	return func(r *Room) {
+		r.idenSource = fn
+	}
+}
+
+// WithCoalescedPings stops activity from pinging the session's watcher.
+// Instead, activity only moves the session's deadline forward, and the watcher
+// checks the deadline when its timer fires, waiting again if it has moved.
+// Busy sessions then cost no channel traffic, and no operation ever waits on a
+// watcher while holding the lock.
+//
+// Sessions still expire at their deadline, but a watcher may wake up several
+// times during a session's life to find the deadline has moved.
+func WithCoalescedPings() Option {
+	return func(r *Room) {
+		r.coalesce = true
+	}
+}
+
+// WithCreateRateLimit limits how quickly sessions can be created. Up to n
+// sessions can be created at once, after which creation is allowed again at a
+// rate of n per the per param. Adding a session while the limit is reached
+// returns ErrRateLimited.
+func WithCreateRateLimit(n int, per time.Duration) Option {
+	return func(r *Room) {
+		r.createLimit = newLimiter(n, per)
+	}
+}
+
+// WithLifetimeJitter randomizes the lifetime of each session by up to the
+// fraction param in either direction, so with a fraction of 0.1 and a lifetime
+// of a minute, sessions live between 54 and 66 seconds without activity. This
+// spreads out the expiry of sessions created at the same time.
+func WithLifetimeJitter(fraction float64) Option {
+	return func(r *Room) {
+		r.dispatcher.jitter = fraction
+	}
+}
+
+// WithRandSource makes the Room use src for randomness that doesn't need to be
+// secure, such as lifetime jitter. It's meant for tests that need the
+// randomness to be deterministic.
+func WithRandSource(src rand.Source) Option {
+	return func(r *Room) {
+		r.dispatcher.random = rand.New(src)
+	}
+}
+
+// WithSharedReaper makes the Room use reaper to remove its expired sessions
+// instead of starting a Reaper of its own. Any number of Rooms can share one
+// Reaper. Closing a Room doesn't stop a shared Reaper, which keeps serving the
+// other Rooms until its Close method is called.
+func WithSharedReaper(reaper *Reaper) Option {
+	return func(r *Room) {
+		r.reaper = reaper
+	}
+}
+
+// WithIdenValidator makes the Room call fn with the iden of every session it's
+// about to create. If fn returns an error, the session isn't created and the
+// error is returned instead. ErrInvalidIden is provided for fn to return.
+func WithIdenValidator(fn func(iden string) error) Option {
+	return func(r *Room) {
+		r.idenValidator = fn
+	}
+}
+
+// WithValueCompression makes the Room gzip values longer than threshold bytes
+// when they're stored, as long as that makes them smaller. Values are
+// decompressed when they're read, so compression is invisible to callers
+// except for the extra CPU time.
+func WithValueCompression(threshold int) Option {
+	return func(r *Room) {
+		r.compressAbove = threshold
+	}
+}
+
+// WithAuditLog makes the Room write a line of JSON to w for every change made
+// to it: sessions being added ("add") and deleted ("del", along with the
+// reason), and keys being set ("set") and deleted ("delkey"). Each line holds
+// the time, the op, the session iden and the key, if any. Values aren't
+// written unless WithAuditValues is also given.
+//
+// Lines are written from a separate goroutine, so a slow w doesn't slow down
+// the Room. Writing carries on after an error, and the first one is returned
+// by AuditErr.
+func WithAuditLog(w io.Writer) Option {
+	return func(r *Room) {
+		r.audit = newAuditLog(w)
+	}
+}
+
+// WithAuditValues makes the audit log, and streams started by StreamChanges,
+// include the values of keys being set.
+func WithAuditValues() Option {
+	return func(r *Room) {
+		r.auditValues = true
+	}
+}
+
+// WithKeyHistory makes the Room remember the last n changes made to the keys of
+// each session, which can be read with History. A session's history is
+// forgotten along with the session.
+func WithKeyHistory(n int) Option {
+	return func(r *Room) {
+		r.historySize = n
+	}
+}
+
+// WithMigrator makes the Room call fn the first time each session is read by
+// Get, GetBatch, GetAllMulti, GetFull, GetWait, GetOrCreate, TryGet or View.
+// If fn reports a change, the session's key-value pairs are replaced by the
+// ones it returns. fn is called with the Room locked, so it must not use the
+// Room. Sessions that are never read are never migrated, and a session renamed
+// by Rotate isn't migrated again.
+func WithMigrator(fn Migrator) Option {
+	return func(r *Room) {
+		r.migrator = fn
+	}
+}
+
+// WithReservationTimeout sets how long reservations made by Reserve last before
+// they're released automatically. It's DefaultReservationTimeout by default.
+func WithReservationTimeout(d time.Duration) Option {
+	return func(r *Room) {
+		r.reserveFor = d
+	}
+}
+
+// WithExpiryWarning makes the Room call fn once a session has no more than the
+// threshold param left to live, so users can be warned before they're logged
+// out. fn is called at most once per deadline, and again only if the session
+// is touched and then nears its new deadline. It isn't called while the Room is
+// frozen, and a session whose lifetime is shorter than threshold is warned
+// about as soon as it's created.
+func WithExpiryWarning(threshold time.Duration, fn func(iden string)) Option {
+	return func(r *Room) {
+		r.dispatcher.warning = threshold
+		r.onWarning = fn
+	}
+}
+
+// WithExpiryWorkers makes the Room call the expiry callbacks of idle sessions
+// from n goroutines of its own instead of from its Reaper, so that slow
+// callbacks don't delay the removal of other expired sessions. Callbacks for
+// sessions removed by the caller, such as with Del, are still called before
+// the removing method returns. Either way, they're called without the Room
+// locked.
+//
+// Callbacks may run concurrently and out of order, so they must be safe to
+// call from multiple goroutines at once.
+func WithExpiryWorkers(n int) Option {
+	return func(r *Room) {
+		if n > 0 {
+			r.expiryPool = newExpiryPool(n)
+		}
+	}
+}
+
+// WithTombstone makes Set, SetChanged and Swap delete the key when they're
+// given the value param, instead of storing it. This suits replication schemes
+// that represent deletions as a special value. Other ways of writing values,
+// such as AddWith and UpdateKey, store the tombstone like any other value.
+func WithTombstone(value string) Option {
+	return func(r *Room) {
+		r.tombstone = &value
+	}
+}
+
+// WithCreationStacks makes the Room record a stack trace whenever it creates a
+// session, which can be read with CreationStack. Capturing stacks is slow, so
+// it's meant for debugging leaks rather than for production.
+func WithCreationStacks() Option {
+	return func(r *Room) {
+		r.traceCreation = true
+	}
+}
+
+// WithShardFunc makes the Room only accept sessions whose iden fn reports as
+// owned by it, so that idens can be spread across several Rooms, such as with
+// consistent hashing across instances. Creating a session the Room doesn't own
+// returns ErrNotOwned. fn may be called with the Room locked, so it must not
+// use the Room.
+func WithShardFunc(fn func(iden string) bool) Option {
+	return func(r *Room) {
+		r.shardFunc = fn
+	}
+}
+
+// WithMinResetInterval makes activity on a session only reset its timer if at
+// least d has passed since the timer was last reset. Activity in between is
+// served as usual, but doesn't keep the session alive any longer.
+//
+// This is meant for Rooms whose timers are reset by requests that are cheap to
+// make: a flood of requests extends a session's life no more than one request
+// every d would, so the idle timer keeps measuring real gaps in activity. It
+// isn't a maximum age, as a session used at least once every lifetime still
+// never expires.
+func WithMinResetInterval(d time.Duration) Option {
+	return func(r *Room) {
+		r.minReset = d
+	}
+}
+
+// WithFactory makes Add and AddAuto seed each new session with the values fn
+// returns, such as ones fetched from a database. fn is called without the Room
+// locked, and the session is only added, holding the values, once it returns.
+// If fn returns an error, the session isn't created and the error is returned
+// instead. Sessions created any other way, such as by AddMany or GetOrCreate,
+// start out empty as usual.
+func WithFactory(fn Factory) Option {
+	return func(r *Room) {
+		r.factory = fn
+	}
+}
+
+// WithExpiryPolicy makes fn decide when each session expires, instead of a
+// lifetime after its last activity. fn is called when the session is created
+// and whenever its timer would be reset, and the session expires at the time
+// it returns. Returning a lifetime after info.LastAccess gives the usual idle
+// expiry, a fixed time after info.CreatedAt gives an absolute one, and the
+// earlier of the two expires sessions on whichever comes first. fn is called
+// with the Room locked, so it must not use the Room.
+//
+// While the Room is frozen, fn isn't called and sessions are given their full
+// lifetime as usual. Watchers of a Room with a policy check the deadline when
+// their timer fires, like with WithCoalescedPings.
+func WithExpiryPolicy(fn ExpiryPolicy) Option {
+	return func(r *Room) {
+		r.policy = fn
+	}
+}
+
+// WithSchema limits the keys sessions are expected to hold to allowedKeys. If
+// strict is true, writing any other key with Set, SetChanged, Swap, UpdateKey,
+// RenameKey, Toggle, IncrementBounded, IncrementWithLimit, TakeToken or AddWith
+// returns ErrUnknownKey and leaves the session unchanged. Otherwise the write
+// goes ahead, and the hook given by WithUnknownKeyHook, if any, is called.
+// Values written by a Loader, Migrator or Factory aren't checked.
+func WithSchema(allowedKeys map[string]struct{}, strict bool) Option {
+	return func(r *Room) {
+		r.schema = make(map[string]struct{}, len(allowedKeys))
+		for k := range allowedKeys {
+			r.schema[k] = struct{}{}
+		}
+		r.strictSchema = strict
+	}
+}
+
+// WithUnknownKeyHook makes the Room call fn whenever a key that isn't in its
+// non-strict schema is written, such as to log a warning. fn is called with the
+// Room locked, so it must not use the Room.
+func WithUnknownKeyHook(fn func(iden, key string)) Option {
+	return func(r *Room) {
+		r.onUnknownKey = fn
+	}
+}
+
+// WithExpiryTombstones makes the Room remember the idens of sessions that
+// expired for ttl after they did, which can be checked with RecentlyExpired.
+// Only the iden and the time of expiry are kept, not the session's values.
+func WithExpiryTombstones(ttl time.Duration) Option {
+	return func(r *Room) {
+		r.tombstoneTTL = ttl
+	}
+}
+
+// WithDeleteGuard makes the Room call fn before a session expires or is
+// deleted by Del, so that sessions in the middle of important work can be
+// kept. If fn returns false, the session isn't removed: an expired session gets
+// another lifetime, and Del returns ErrVetoed. Grouped sessions that expire
+// together are all kept if fn wants to keep any of them. Other ways of removing
+// sessions, such as DelGroup, DelByTag or ReplaceAll, don't consult fn. fn is
+// called with the Room locked, so it must not use the Room.
+func WithDeleteGuard(fn func(iden string, reason Reason) bool) Option {
+	return func(r *Room) {
+		r.deleteGuard = fn
+	}
+}
+
+// WithTTLGranularity makes the Room round the TTLs it reports to the nearest
+// multiple of d, such as whole seconds, so they're fit to show to users. It
+// affects SessionsByTTL, Iterator, NextExpiry and ExpiringWithin, which
+// compares the rounded TTLs. Sessions still expire precisely on time, and
+// WriteTo still saves precise TTLs.
+func WithTTLGranularity(d time.Duration) Option {
+	return func(r *Room) {
+		r.granularity = d
+	}
+}